@@ -0,0 +1,231 @@
+// Copyright 2013 The gopp AUTHORS. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gopp
+
+import (
+	"sort"
+	"strings"
+)
+
+// An Analysis describes what each of a grammar's rules can match, without
+// parsing anything.
+type Analysis struct {
+	// Nullable holds the rules that can succeed without consuming any tokens.
+	Nullable map[string]bool
+	// First holds, for each rule, the tokens that can begin it, in the same
+	// notation as ParseError's Expected: 'literal' for literals and <name>
+	// for symbols.
+	First map[string][]string
+
+	g Grammar
+	// leftCalls holds, for each rule, the rules that can be reached from it
+	// without consuming any tokens.
+	leftCalls map[string]map[string]bool
+}
+
+// Analyze works out which rules are nullable, and their FIRST sets.
+func (g Grammar) Analyze() (a *Analysis) {
+	a = &Analysis{
+		Nullable:  map[string]bool{},
+		First:     map[string][]string{},
+		g:         g,
+		leftCalls: map[string]map[string]bool{},
+	}
+
+	// both grow until nothing changes.
+	for changed := true; changed; {
+		changed = false
+		for _, rule := range g.Rules {
+			if !a.Nullable[rule.Name] && a.exprNullable(rule.Expr) {
+				a.Nullable[rule.Name] = true
+				changed = true
+			}
+		}
+	}
+	first := map[string]map[string]bool{}
+	for _, rule := range g.Rules {
+		first[rule.Name] = map[string]bool{}
+		a.leftCalls[rule.Name] = map[string]bool{}
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, rule := range g.Rules {
+			before := len(first[rule.Name]) + len(a.leftCalls[rule.Name])
+			a.exprFirst(rule.Expr, first, first[rule.Name], a.leftCalls[rule.Name])
+			if len(first[rule.Name])+len(a.leftCalls[rule.Name]) != before {
+				changed = true
+			}
+		}
+	}
+	for name, set := range first {
+		list := []string{}
+		for what := range set {
+			list = append(list, what)
+		}
+		sort.Strings(list)
+		a.First[name] = list
+	}
+	return
+}
+
+func (a *Analysis) exprNullable(expr Expr) bool {
+	for _, term := range expr {
+		if !a.termNullable(term) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *Analysis) termNullable(term Term) bool {
+	switch t := term.(type) {
+	case RepeatZeroTerm, OptionalTerm, TagTerm:
+		return true
+	case RepeatOneTerm:
+		return a.termNullable(t.Term)
+	case GroupTerm:
+		return a.exprNullable(t.Expr)
+	case AlternationTerm:
+		for _, expr := range t.Exprs {
+			if a.exprNullable(expr) {
+				return true
+			}
+		}
+	case RuleTerm:
+		return a.Nullable[t.Name]
+	case InlineRuleTerm:
+		return a.Nullable[t.Name]
+	}
+	return false
+}
+
+// exprFirst adds what can begin expr to into, and the rules it can begin
+// with to calls.
+func (a *Analysis) exprFirst(expr Expr, first map[string]map[string]bool, into, calls map[string]bool) {
+	for _, term := range expr {
+		a.termFirst(term, first, into, calls)
+		if !a.termNullable(term) {
+			return
+		}
+	}
+}
+
+func (a *Analysis) termFirst(term Term, first map[string]map[string]bool, into, calls map[string]bool) {
+	addRule := func(name string) {
+		calls[name] = true
+		for what := range first[name] {
+			into[what] = true
+		}
+	}
+	switch t := term.(type) {
+	case RepeatZeroTerm:
+		a.termFirst(t.Term, first, into, calls)
+	case RepeatOneTerm:
+		a.termFirst(t.Term, first, into, calls)
+	case OptionalTerm:
+		a.exprFirst(t.Expr, first, into, calls)
+	case GroupTerm:
+		a.exprFirst(t.Expr, first, into, calls)
+	case AlternationTerm:
+		for _, expr := range t.Exprs {
+			a.exprFirst(expr, first, into, calls)
+		}
+	case RuleTerm:
+		addRule(t.Name)
+	case InlineRuleTerm:
+		if len(a.g.RulesForName(t.Name)) != 0 {
+			addRule(t.Name)
+		}
+		// if the rules fail, a symbol is tried instead.
+		if _, ok := a.g.Symbol(t.Name); ok {
+			into["<"+t.Name+">"] = true
+		}
+	case LiteralTerm:
+		into[quoteLiteral(t.Literal)] = true
+	}
+}
+
+// EmptyLoops finds the repetitions in a rule whose term can match without
+// consuming any tokens, which would repeat forever if the parser didn't stop
+// them.
+func (a *Analysis) EmptyLoops(rule Rule) (loops []Term) {
+	forEachTerm(rule.Expr, func(term Term) {
+		switch t := term.(type) {
+		case RepeatZeroTerm:
+			if a.termNullable(t.Term) {
+				loops = append(loops, term)
+			}
+		case RepeatOneTerm:
+			if a.termNullable(t.Term) {
+				loops = append(loops, term)
+			}
+		}
+	})
+	return
+}
+
+// LeftRecursion finds a way for the rule name to be reached from itself
+// without consuming any tokens, returning the rules along the way, starting
+// and ending with name, or nil if there is none.
+func (a *Analysis) LeftRecursion(name string) (cycle []string) {
+	// breadth first, so the shortest cycle is found.
+	from := map[string]string{}
+	queue := []string{name}
+	for len(queue) != 0 {
+		current := queue[0]
+		queue = queue[1:]
+		var calls []string
+		for call := range a.leftCalls[current] {
+			calls = append(calls, call)
+		}
+		sort.Strings(calls)
+		for _, call := range calls {
+			if call == name {
+				cycle = []string{name}
+				for at := current; at != name; at = from[at] {
+					cycle = append(cycle, at)
+				}
+				cycle = append(cycle, name)
+				// it was built backwards, after the first.
+				for i, j := 1, len(cycle)-2; i < j; i, j = i+1, j-1 {
+					cycle[i], cycle[j] = cycle[j], cycle[i]
+				}
+				return
+			}
+			if _, seen := from[call]; !seen {
+				from[call] = current
+				queue = append(queue, call)
+			}
+		}
+	}
+	return
+}
+
+// analysis reports repetitions that can match nothing, which are errors, and
+// indirect left recursion, which works but is slow and easy to get wrong.
+func (v *validator) analysis() {
+	a := v.g.Analyze()
+	for _, rule := range v.g.Rules {
+		for _, loop := range a.EmptyLoops(rule) {
+			v.errorf(rule.Name, "Rule %q repeats %v, which can match without consuming anything.", rule.Name, loop)
+		}
+	}
+	reported := map[string]bool{}
+	for _, rule := range v.g.Rules {
+		if reported[rule.Name] {
+			continue
+		}
+		reported[rule.Name] = true
+		cycle := a.LeftRecursion(rule.Name)
+		if len(cycle) <= 2 {
+			// no recursion, or the direct kind.
+			continue
+		}
+		for _, name := range cycle {
+			reported[name] = true
+		}
+		v.warnf(rule.Name, "Rule %q is indirectly left-recursive, through %s.", rule.Name, strings.Join(cycle, " -> "))
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2013 The gopp AUTHORS. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gopp_test
+
+import (
+	"github.com/skelterjohn/gopp"
+	"reflect"
+	"testing"
+)
+
+const loopygopp = `
+Start => (<<Opt>>)* <<List>> 'x'
+List => <<Opt>>+ <Item>
+Opt => ['y'] {tag}
+Item => <A> | <num>
+A => <B> 'a'
+B => [<Item>] 'b'
+num = /([0-9]+)/
+`
+
+func TestAnalyze(t *testing.T) {
+	g, err := gopp.NewGrammar(loopygopp)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	a := g.Analyze()
+	nullable := map[string]bool{"Opt": true}
+	if !reflect.DeepEqual(a.Nullable, nullable) {
+		t.Errorf("Expected nullable %v, got %v.", nullable, a.Nullable)
+	}
+	first := map[string][]string{
+		"Start": {"'b'", "'y'", "<num>"},
+		"List":  {"'b'", "'y'", "<num>"},
+		"Opt":   {"'y'"},
+		"Item":  {"'b'", "<num>"},
+		"A":     {"'b'", "<num>"},
+		"B":     {"'b'", "<num>"},
+	}
+	if !reflect.DeepEqual(a.First, first) {
+		t.Errorf("Expected first sets %v, got %v.", first, a.First)
+	}
+	cycle := []string{"Item", "A", "B", "Item"}
+	if got := a.LeftRecursion("Item"); !reflect.DeepEqual(got, cycle) {
+		t.Errorf("Expected cycle %v, got %v.", cycle, got)
+	}
+	if got := a.LeftRecursion("Start"); got != nil {
+		t.Errorf("Expected no cycle for Start, got %v.", got)
+	}
+
+	expected := []string{
+		`Rule "Start" repeats RepeatZeroTerm(GroupTerm([RuleTerm(Opt)])), which can match without consuming anything.`,
+		`Rule "List" repeats RepeatOneTerm(RuleTerm(Opt)), which can match without consuming anything.`,
+		`warning: Rule "Item" is indirectly left-recursive, through Item -> A -> B -> Item.`,
+	}
+	var got []string
+	for _, ge := range g.Validate("Start") {
+		got = append(got, ge.Error())
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected problems %q, got %q.", expected, got)
+	}
+}
+
+func TestEmptyLoopGuard(t *testing.T) {
+	g, err := gopp.NewGrammar(loopygopp)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	cases := []struct {
+		document string
+		items    int
+	}{
+		{"yyy7x", 4},
+		{"7x", 1},
+	}
+	for _, c := range cases {
+		ast, err := gopp.Parse(g, "Start", []byte(c.document))
+		if err != nil {
+			t.Errorf("With %q, got error %v.", c.document, err)
+			continue
+		}
+		// the repetition of Opts holds one subtree for each 'y'.
+		if opts := ast[0].([]gopp.Node); len(opts) != c.items-1 {
+			t.Errorf("With %q, expected %d Opts, got %v.", c.document, c.items-1, opts)
+		}
+	}
+}
@@ -84,6 +84,12 @@ var ByHandGrammar = Grammar{
 				},
 			},
 		},
+		Rule{ // Term => Alternation
+			Name: "Term",
+			Expr: Expr{
+				InlineRuleTerm{Name: "Alternation"},
+			},
+		},
 		Rule{ // Term => Term1
 			Name: "Term",
 			Expr: Expr{
@@ -96,6 +102,44 @@ var ByHandGrammar = Grammar{
 				InlineRuleTerm{Name: "Term2"},
 			},
 		},
+		Rule{ // Alternation => {type=AlternationTerm} {field=Exprs} <<Sequence>> {field=.} ('|' {field=Exprs} <<Sequence>>)+
+			Name: "Alternation",
+			Expr: Expr{
+				TagTerm{Tag: "type=AlternationTerm"},
+				TagTerm{Tag: "field=Exprs"},
+				RuleTerm{Name: "Sequence"},
+				TagTerm{Tag: "field=."},
+				RepeatOneTerm{
+					GroupTerm{
+						Expr{
+							LiteralTerm{Literal: "|"},
+							TagTerm{Tag: "field=Exprs"},
+							RuleTerm{Name: "Sequence"},
+						},
+					},
+				},
+			},
+		},
+		Rule{ // Sequence => <<SequenceTerm>>+
+			Name: "Sequence",
+			Expr: Expr{
+				RepeatOneTerm{
+					RuleTerm{Name: "SequenceTerm"},
+				},
+			},
+		},
+		Rule{ // SequenceTerm => Term1
+			Name: "SequenceTerm",
+			Expr: Expr{
+				InlineRuleTerm{Name: "Term1"},
+			},
+		},
+		Rule{ // SequenceTerm => Term2
+			Name: "SequenceTerm",
+			Expr: Expr{
+				InlineRuleTerm{Name: "Term2"},
+			},
+		},
 		Rule{ // Term => {type=RepeatZeroTerm} {field=Term} <<Term>> '*'
 			Name: "Term1",
 			Expr: Expr{
@@ -245,7 +289,6 @@ func mkRule(name string, nodes ...Node) []Node {
 			Literal("\n"),
 		},
 	}
-	return nodes
 }
 
 func mkLexStep(name, pattern string) []Node {
@@ -305,6 +348,34 @@ func mkOptionalTerm(node Node) []Node {
 	}
 }
 
+func mkGroupTerm(nodes ...Node) []Node {
+	return []Node{
+		Tag("type=GroupTerm"),
+		Literal("("),
+		Tag("field=Expr"),
+		mkExpr(nodes...),
+		Literal(")"),
+	}
+}
+
+func mkAlternationTerm(exprs ...[]Node) []Node {
+	var rest []Node
+	for _, expr := range exprs[1:] {
+		rest = append(rest,
+			Literal("|"),
+			Tag("field=Exprs"),
+			[]Node{expr},
+		)
+	}
+	return []Node{
+		Tag("type=AlternationTerm"),
+		Tag("field=Exprs"),
+		[]Node{exprs[0]},
+		Tag("field=."),
+		rest,
+	}
+}
+
 func mkRuleTerm(text string) []Node {
 	return []Node{
 		Tag("type=RuleTerm"),
@@ -390,12 +461,35 @@ var ByHandGoppAST = mkGrammar(
 		mkRule("Expr",
 			mkRepeatOneTerm(mkRuleTerm("Term")),
 		),
+		mkRule("Term",
+			mkInlineRuleTerm("Alternation"),
+		),
 		mkRule("Term",
 			mkInlineRuleTerm("Term1"),
 		),
 		mkRule("Term",
 			mkInlineRuleTerm("Term2"),
 		),
+		mkRule("Alternation",
+			mkTagTerm("type=AlternationTerm"),
+			mkTagTerm("field=Exprs"),
+			mkRuleTerm("Sequence"),
+			mkTagTerm("field=."),
+			mkRepeatOneTerm(mkGroupTerm(
+				mkLiteralTerm("|"),
+				mkTagTerm("field=Exprs"),
+				mkRuleTerm("Sequence"),
+			)),
+		),
+		mkRule("Sequence",
+			mkRepeatOneTerm(mkRuleTerm("SequenceTerm")),
+		),
+		mkRule("SequenceTerm",
+			mkInlineRuleTerm("Term1"),
+		),
+		mkRule("SequenceTerm",
+			mkInlineRuleTerm("Term2"),
+		),
 		mkRule("Term1",
 			mkTagTerm("type=RepeatZeroTerm"),
 			mkTagTerm("field=Term"),
@@ -0,0 +1,174 @@
+// Copyright 2013 The gopp AUTHORS. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Command gopp tries out a .gopp grammar on a document.
+
+Usage:
+
+	gopp command [-start rule] grammar.gopp [document]
+	gopp lint [-start rule] grammar.gopp
+
+The document is read from standard input if it isn't named. The commands are
+
+	tokens  print the document's tokens, one per line
+	ast     print the document's AST as an S-expression
+	json    print the document's AST as JSON
+	lint    print the problems gopp.Grammar.Validate finds with the grammar
+
+The start rule defaults to the first rule in the grammar. If the document
+can't be tokenized or parsed, the error is printed with the offending line
+and gopp exits with status 1. Problems with the grammar give status 3, though
+lint gives status 0 if it found only warnings, and bad usage or unreadable
+files give status 2.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/skelterjohn/gopp"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	exitOK = iota
+	exitDocument
+	exitUsage
+	exitGrammar
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func usage(stderr io.Writer) int {
+	fmt.Fprintln(stderr, "usage: gopp tokens|ast|json [-start rule] grammar.gopp [document]")
+	fmt.Fprintln(stderr, "       gopp lint [-start rule] grammar.gopp")
+	return exitUsage
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		return usage(stderr)
+	}
+	command := args[0]
+	switch command {
+	case "tokens", "ast", "json", "lint":
+	default:
+		fmt.Fprintf(stderr, "gopp: unknown command %q\n", command)
+		return usage(stderr)
+	}
+
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	start := fs.String("start", "", "the rule to start parsing with")
+	if err := fs.Parse(args[1:]); err != nil {
+		return exitUsage
+	}
+	maxArgs := 2
+	if command == "lint" {
+		maxArgs = 1
+	}
+	if fs.NArg() < 1 || fs.NArg() > maxArgs {
+		return usage(stderr)
+	}
+
+	grammarName := fs.Arg(0)
+	grammarText, err := ioutil.ReadFile(grammarName)
+	if err != nil {
+		fmt.Fprintf(stderr, "gopp: %v\n", err)
+		return exitUsage
+	}
+	g, err := gopp.NewGrammar(string(grammarText))
+	if err != nil {
+		report(stderr, grammarName, grammarText, err)
+		return exitGrammar
+	}
+	if command == "lint" {
+		errs := g.Validate(*start)
+		for _, ge := range errs {
+			fmt.Fprintf(stdout, "%s: %v\n", grammarName, ge)
+		}
+		if !errs.Warnings() {
+			return exitGrammar
+		}
+		return exitOK
+	}
+
+	docName := "<stdin>"
+	var document []byte
+	if fs.NArg() == 2 {
+		docName = fs.Arg(1)
+		document, err = ioutil.ReadFile(docName)
+	} else {
+		document, err = ioutil.ReadAll(stdin)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "gopp: %v\n", err)
+		return exitUsage
+	}
+
+	cg, err := gopp.Compile(g)
+	if err != nil {
+		report(stderr, grammarName, grammarText, err)
+		return exitGrammar
+	}
+	if *start == "" && len(g.Rules) != 0 {
+		*start = g.Rules[0].Name
+	}
+
+	if command == "tokens" {
+		tokens, err := gopp.Tokenize(cg.TokenizeInfo, document)
+		if err != nil {
+			report(stderr, docName, document, err)
+			return exitDocument
+		}
+		for _, t := range tokens {
+			fmt.Fprintf(stdout, "%d:%d\t%s\t%q\n", t.Row, t.Col, t.Type, t.Text)
+		}
+		return exitOK
+	}
+
+	if len(cg.RulesForName(*start)) == 0 {
+		fmt.Fprintf(stderr, "%s: no rule named %q\n", grammarName, *start)
+		return exitGrammar
+	}
+	ast, err := cg.Parse(*start, document)
+	if err != nil {
+		report(stderr, docName, document, err)
+		return exitDocument
+	}
+
+	var out []byte
+	switch command {
+	case "ast":
+		out, err = gopp.MarshalSexp(ast)
+	case "json":
+		var buf bytes.Buffer
+		if out, err = json.Marshal(ast); err == nil {
+			err = json.Indent(&buf, out, "", "  ")
+			buf.WriteByte('\n')
+			out = buf.Bytes()
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "gopp: %v\n", err)
+		return exitDocument
+	}
+	stdout.Write(out)
+	return exitOK
+}
+
+// report prints err, with the lines of the file it happened in, if it says
+// where.
+func report(stderr io.Writer, name string, text []byte, err error) {
+	rendered := strings.TrimRight(gopp.RenderError(text, err), "\n")
+	fmt.Fprintf(stderr, "%s: %s\n", name, rendered)
+}
@@ -0,0 +1,121 @@
+// Copyright 2013 The gopp AUTHORS. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const sumgopp = `
+ignore: /^[ \t]+/
+Sum => {field=Terms} <<Term>> ('+' <<Term>>)* '\n'
+Term => {field=N} <number>
+number = /(\d+)/
+`
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	grammar := filepath.Join(dir, "sum.gopp")
+	broken := filepath.Join(dir, "broken.gopp")
+	unused := filepath.Join(dir, "unused.gopp")
+	document := filepath.Join(dir, "doc.txt")
+	for name, text := range map[string]string{
+		grammar:  sumgopp,
+		broken:   "Sum => <<Term>\n",
+		unused:   "Sum => <number>\nExtra => <number>\nnumber = /(\\d+)/\n",
+		document: "1 + 2\n",
+	} {
+		if err := ioutil.WriteFile(name, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		args   []string
+		stdin  string
+		status int
+		stdout string
+		stderr string
+	}{
+		{
+			args:   []string{"tokens", grammar, document},
+			stdout: "0:0\tnumber\t\"1\"\n0:2\tRAW\t\"+\"\n0:4\tnumber\t\"2\"\n0:5\tRAW\t\"\\n\"\n",
+		},
+		{
+			args:   []string{"ast", grammar},
+			stdin:  "3\n",
+			stdout: "({field=Terms}\n  ({field=N} <number:\"3\">)\n  ()\n  '\\n')\n",
+		},
+		{
+			args:   []string{"json", "-start", "Sum", grammar, document},
+			stdout: `"text": "2"`,
+		},
+		{
+			args:   []string{"ast", grammar},
+			stdin:  "1 +\n",
+			status: exitDocument,
+			stderr: "<stdin>: expected <number> but found '\\n' at 0:3\n1 | 1 +\n  |    ^\n",
+		},
+		{
+			args:   []string{"tokens", grammar},
+			stdin:  "1 x",
+			status: exitDocument,
+			stderr: `<stdin>: Could not match starting from "x".`,
+		},
+		{
+			args:   []string{"ast", broken},
+			stdin:  "1\n",
+			status: exitGrammar,
+			stderr: "^",
+		},
+		{
+			args:   []string{"ast", "-start", "Nope", grammar},
+			status: exitGrammar,
+			stderr: `no rule named "Nope"`,
+		},
+		{
+			args: []string{"lint", grammar},
+		},
+		{
+			args:   []string{"lint", "-start", "Sum", unused},
+			stdout: unused + `: warning: Rule "Extra" can't be reached from "Sum".`,
+		},
+		{
+			args:   []string{"lint", "-start", "Nope", grammar},
+			status: exitGrammar,
+			stdout: `Start rule "Nope" is not defined.`,
+		},
+		{
+			args:   []string{"lint", grammar, document},
+			status: exitUsage,
+		},
+		{
+			args:   []string{"parse", grammar},
+			status: exitUsage,
+			stderr: "usage:",
+		},
+		{
+			args:   []string{"ast", filepath.Join(dir, "missing.gopp")},
+			status: exitUsage,
+		},
+	}
+	for _, c := range cases {
+		var stdout, stderr bytes.Buffer
+		status := run(c.args, strings.NewReader(c.stdin), &stdout, &stderr)
+		if status != c.status {
+			t.Errorf("With %v, expected status %d, got %d: %s", c.args, c.status, status, stderr.String())
+		}
+		if !strings.Contains(stdout.String(), c.stdout) {
+			t.Errorf("With %v, expected output %q, got %q.", c.args, c.stdout, stdout.String())
+		}
+		if !strings.Contains(stderr.String(), c.stderr) {
+			t.Errorf("With %v, expected errors %q, got %q.", c.args, c.stderr, stderr.String())
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2013 The gopp AUTHORS. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gopp
+
+import (
+	"bytes"
+	"io"
+)
+
+// A CST is a concrete syntax tree. It has the same shape as the AST parsed
+// alongside it, but its leaves keep the tokens they came from, along with the
+// ignored text around them, so that the document can be reproduced exactly.
+type CST struct {
+	Root *CSTNode
+	AST  AST
+	// Trailing is the ignored text after the last token.
+	Trailing []Trivia
+}
+
+// A CSTNode stands for one node of the AST. Subtrees have Children, and
+// leaves have the Node itself, with the token that a Literal or SymbolText
+// was parsed from, or the tokens an ErrorNode skipped. Trivia lines up with
+// Tokens.
+type CSTNode struct {
+	Node     Node
+	Tokens   []Token
+	Trivia   []TokenTrivia
+	Children []*CSTNode
+}
+
+func ParseCST(g Grammar, startRule string, document []byte) (cst *CST, err error) {
+	cg, err := Compile(g)
+	if err != nil {
+		return
+	}
+	cst, err = cg.ParseCST(startRule, document)
+	return
+}
+
+// ParseCST parses document like Parse, keeping what Parse throws away. As
+// with Parse, if the parser recovered from errors, the CST is returned along
+// with them.
+func (cg *CompiledGrammar) ParseCST(startRule string, document []byte) (cst *CST, err error) {
+	tokens, trivia, trailing, err := TokenizeTrivia(cg.TokenizeInfo, document)
+	if err != nil {
+		return
+	}
+	pd := NewParseData()
+	pd.documentEnd = len(document)
+	ast, err := cg.parseAll(startRule, tokens, pd)
+	if ast == nil {
+		return
+	}
+	cst = &CST{
+		AST:      ast,
+		Trailing: trailing,
+	}
+	cst.Root, _, _ = newCSTNode([]Node(ast), tokens, trivia)
+	return
+}
+
+// newCSTNode builds the CSTNode for node, taking the tokens it was parsed from
+// and their trivia off the front of tokens and trivia.
+func newCSTNode(node Node, tokens []Token, trivia []TokenTrivia) (cn *CSTNode, remaining []Token, remainingTrivia []TokenTrivia) {
+	cn = &CSTNode{}
+	remaining, remainingTrivia = tokens, trivia
+	n := 0
+	switch node := node.(type) {
+	case AST:
+		return newCSTNode([]Node(node), tokens, trivia)
+	case []Node:
+		for _, child := range node {
+			var cchild *CSTNode
+			cchild, remaining, remainingTrivia = newCSTNode(child, remaining, remainingTrivia)
+			cn.Children = append(cn.Children, cchild)
+		}
+		return
+	case Literal, SymbolText:
+		n = 1
+	case ErrorNode:
+		n = len(node.Skipped)
+	}
+	cn.Tokens, remaining = remaining[:n], remaining[n:]
+	cn.Trivia, remainingTrivia = remainingTrivia[:n], remainingTrivia[n:]
+	cn.Node = node
+	return
+}
+
+// WriteTo writes the document the CST was parsed from.
+func (cst *CST) WriteTo(w io.Writer) (n int64, err error) {
+	var buf bytes.Buffer
+	cst.Root.write(&buf)
+	writeTrivia(&buf, cst.Trailing)
+	return buf.WriteTo(w)
+}
+
+// Bytes returns the document the CST was parsed from.
+func (cst *CST) Bytes() []byte {
+	var buf bytes.Buffer
+	cst.WriteTo(&buf)
+	return buf.Bytes()
+}
+
+func (cn *CSTNode) write(buf *bytes.Buffer) {
+	for i, t := range cn.Tokens {
+		writeTrivia(buf, cn.Trivia[i].Leading)
+		buf.WriteString(t.Raw)
+		writeTrivia(buf, cn.Trivia[i].Trailing)
+	}
+	for _, child := range cn.Children {
+		child.write(buf)
+	}
+}
+
+func writeTrivia(buf *bytes.Buffer, trivia []Trivia) {
+	for _, t := range trivia {
+		buf.WriteString(t.Raw)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2013 The gopp AUTHORS. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gopp_test
+
+import (
+	"github.com/skelterjohn/gopp"
+	"testing"
+)
+
+func cstTokens(cn *gopp.CSTNode) (tokens []gopp.Token, trivia []gopp.TokenTrivia) {
+	tokens = append(tokens, cn.Tokens...)
+	trivia = append(trivia, cn.Trivia...)
+	for _, child := range cn.Children {
+		ctokens, ctrivia := cstTokens(child)
+		tokens = append(tokens, ctokens...)
+		trivia = append(trivia, ctrivia...)
+	}
+	return
+}
+
+func TestParseCST(t *testing.T) {
+	cg, err := gopp.Compile(gopp.ByHandGrammar)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	documents := []string{
+		"X=>'y'\n",
+		"# header\n\nX => 'y' \t# why\n\n  w = /z/\n# footer\n  ",
+	}
+	for _, document := range documents {
+		cst, err := cg.ParseCST("Grammar", []byte(document))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(cst.Bytes()) != document {
+			t.Errorf("Expected %q, got %q.", document, cst.Bytes())
+		}
+	}
+
+	cst, err := cg.ParseCST("Grammar", []byte(documents[1]))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	tokens, trivia := cstTokens(cst.Root)
+	if len(tokens) != 9 || len(trivia) != 9 {
+		t.Errorf("Expected 9 tokens, got %v.", tokens)
+		return
+	}
+	if nl, tt := tokens[0], trivia[0]; nl.Text != "\n" || len(tt.Leading) != 1 || tt.Leading[0].Raw != "# header\n" {
+		t.Errorf("Expected the first newline to be led by the header, got %v with %v.", nl, tt.Leading)
+	}
+	if y, tt := tokens[3], trivia[3]; y.Text != "y" || len(tt.Trailing) != 2 || tt.Trailing[1].Raw != "# why\n" {
+		t.Errorf("Expected 'y' to be followed by a comment, got %v with %v.", y, tt.Trailing)
+	}
+	if w, tt := tokens[5], trivia[5]; w.Text != "w" || len(tt.Leading) != 1 || tt.Leading[0].Raw != "  " || tt.Leading[0].Offset != 27 {
+		t.Errorf("Expected w to be indented, got %v with %v.", w, tt.Leading)
+	}
+	if len(cst.Trailing) != 2 || cst.Trailing[0].Raw != "# footer\n" || cst.Trailing[1].Row != 6 {
+		t.Errorf("Expected the footer to trail the document, got %v.", cst.Trailing)
+	}
+}
@@ -5,18 +5,18 @@
 package gopp
 
 import (
+	"encoding"
 	"errors"
 	"fmt"
 	"github.com/skelterjohn/debugtags"
 	"io"
-	"io/ioutil"
 	"reflect"
 	"strconv"
 	"strings"
 )
 
 type DecoderFactory struct {
-	g     Grammar
+	g     *CompiledGrammar
 	start string
 	types map[string]reflect.Type
 }
@@ -26,6 +26,19 @@ func NewDecoderFactory(gopp string, start string) (df *DecoderFactory, err error
 		start: start,
 		types: map[string]reflect.Type{},
 	}
+	g, err := NewGrammar(gopp)
+	if err != nil {
+		return
+	}
+	df.g, err = Compile(g)
+	if err != nil {
+		return
+	}
+	return
+}
+
+// NewGrammar reads a grammar in .gopp format.
+func NewGrammar(gopp string) (g Grammar, err error) {
 	ast, err := Parse(ByHandGrammar, "Grammar", []byte(gopp))
 	if err != nil {
 		return
@@ -35,20 +48,26 @@ func NewDecoderFactory(gopp string, start string) (df *DecoderFactory, err error
 	sa.RegisterType(RepeatOneTerm{})
 	sa.RegisterType(OptionalTerm{})
 	sa.RegisterType(GroupTerm{})
+	sa.RegisterType(AlternationTerm{})
 	sa.RegisterType(RuleTerm{})
 	sa.RegisterType(InlineRuleTerm{})
 	sa.RegisterType(TagTerm{})
 	sa.RegisterType(LiteralTerm{})
-	err = sa.Decode(&df.g)
-	if err != nil {
-		return
-	}
+	err = sa.Decode(&g)
 	return
 }
 
+// RegisterType lets x's type be named by {type=T} tags, using its name
+// without the package, like "Expr".
 func (df *DecoderFactory) RegisterType(x interface{}) {
-	typ := reflect.TypeOf(x)
-	df.types[typ.Name()] = typ
+	df.RegisterTypeAs(reflect.TypeOf(x).Name(), x)
+}
+
+// RegisterTypeAs lets x's type be named by {type=name} tags, so that types
+// from different packages with the same name, like "ast.Expr" and
+// "types.Expr", can both be used.
+func (df *DecoderFactory) RegisterTypeAs(name string, x interface{}) {
+	df.types[name] = reflect.TypeOf(x)
 }
 
 func (df *DecoderFactory) NewDecoder(r io.Reader) (d Decoder) {
@@ -59,22 +78,74 @@ func (df *DecoderFactory) NewDecoder(r io.Reader) (d Decoder) {
 	return
 }
 
+// A Decoder reads a stream of documents, each a single match of the start
+// rule, one after another. Like encoding/json's Decoder, it reads only as much
+// of its input as it needs to find where each match ends.
 type Decoder struct {
 	*DecoderFactory
 	io.Reader
+
+	// tokens holds input that has been tokenized but not yet decoded, and
+	// buf the input after it that hasn't been tokenized yet, which starts at
+	// bufStart.
+	tokens   []Token
+	buf      []byte
+	bufStart Pos
+	eof      bool
+	readErr  error
+	// tokenizeErr is where the input stopped matching any token, once all of
+	// it has been read. It is only reported when decoding gets that far.
+	tokenizeErr error
+	// leftover is the error the last match would have had if the input had
+	// ended with it. If it is farther along than the next match's error, it
+	// is reported instead, since it is where the input really went wrong.
+	leftover *ParseError
+	// err is kept once the decoder cannot go any further.
+	err error
+
+	disallowDuplicateKeys bool
+	strict                bool
 }
 
+// Strict turns on strict mode for decoding, as described for
+// StructuredAST.Strict.
+func (d *Decoder) Strict() {
+	d.strict = true
+}
+
+// DisallowDuplicateKeys makes it an error for a document to give the same
+// key twice when decoding into a map.
+func (d *Decoder) DisallowDuplicateKeys() {
+	d.disallowDuplicateKeys = true
+}
+
+// decodeChunkSize is the least a Decoder reads when what it has buffered is
+// not enough. It reads more when the match it is looking for is already
+// long, so that the match is only parsed a few times as it grows.
+const decodeChunkSize = 4096
+
+// Decode parses the next match of the start rule and decodes it into obj.
+// At the end of the input, it returns io.EOF. Positions in errors and Pos
+// fields are relative to the start of the input, not the match.
 func (d *Decoder) Decode(obj interface{}) (err error) {
-	document, err := ioutil.ReadAll(d.Reader)
-	if err != nil {
+	if d.err != nil {
+		err = d.err
 		return
 	}
-	ast, err := Parse(d.g, d.start, document)
+	ast, pd, err := d.next()
 	if err != nil {
+		// errors that were recovered from still leave an AST, and the
+		// decoder past them.
+		if ast == nil {
+			d.err = err
+		}
 		return
 	}
 	sa := NewStructuredAST(ast)
 	sa.types = d.types
+	sa.positions = pd.Positions
+	sa.disallowDuplicateKeys = d.disallowDuplicateKeys
+	sa.strict = d.strict
 	err = sa.Decode(obj)
 	if err != nil {
 		return
@@ -82,6 +153,130 @@ func (d *Decoder) Decode(obj interface{}) (err error) {
 	return
 }
 
+// More reports whether there is anything left in the input, other than
+// ignored text, for Decode to parse. It returns false once Decode has
+// returned an error it could not get past.
+func (d *Decoder) More() bool {
+	if d.err != nil {
+		return false
+	}
+	for len(d.tokens) == 0 && !d.eof {
+		if d.more() != nil {
+			return true
+		}
+	}
+	return len(d.tokens) != 0 || d.tokenizeErr != nil
+}
+
+// next parses the next match of the start rule, reading more input until
+// doing so could not change where the match ends.
+func (d *Decoder) next() (ast AST, pd *ParseData, err error) {
+	for {
+		if len(d.tokens) == 0 && !d.eof {
+			if err = d.more(); err != nil {
+				return
+			}
+			continue
+		}
+		if len(d.tokens) == 0 {
+			err = io.EOF
+			if d.tokenizeErr != nil {
+				err = d.tokenizeErr
+			}
+			return
+		}
+
+		pd = NewParseData()
+		pd.documentEnd = d.bufStart.Offset + len(d.buf)
+		var items []Node
+		var remaining []Token
+		items, remaining, err = d.g.parseTokens(d.start, d.tokens, pd)
+		lookedPastEnd := pd.expected != nil && pd.expectedAt == 0
+		if !d.eof && (lookedPastEnd || err == nil && len(remaining) == 0) {
+			// the match may go on in the input not read yet.
+			if err = d.more(); err != nil {
+				return
+			}
+			continue
+		}
+		if lookedPastEnd && d.tokenizeErr != nil {
+			err = d.tokenizeErr
+			return
+		}
+		if err != nil {
+			if pe, ok := err.(*ParseError); ok && d.leftover != nil && d.leftover.Offset >= pe.Offset {
+				err = d.leftover
+			}
+			return
+		}
+		if len(remaining) == len(d.tokens) {
+			err = recoveredErrors(items, pd.parseError(d.tokens, remaining, true))
+			return
+		}
+
+		tokens := d.tokens[:len(d.tokens)-len(remaining)]
+		d.leftover = nil
+		if len(remaining) != 0 {
+			d.leftover = pd.parseError(d.tokens, remaining, true)
+		}
+		d.tokens = remaining
+		err = recoveredErrors(items, nil)
+		pd.Positions = newPositions(items, tokens)
+		ast = items
+		return
+	}
+}
+
+// more reads more input and tokenizes what it can of it, keeping the tokens
+// for the matches to come.
+func (d *Decoder) more() (err error) {
+	size := decodeChunkSize
+	if len(d.tokens) != 0 {
+		if buffered := d.bufStart.Offset + len(d.buf) - d.tokens[0].Offset; buffered > size {
+			size = buffered
+		}
+	}
+	if err = d.fill(size); err != nil {
+		return
+	}
+	tokens, terr := tokenizeFrom(d.g.TokenizeInfo, d.buf, d.bufStart)
+	if terr != nil {
+		// the tokens before the problem are still good, and without the
+		// rest of the input the problem may go away.
+		if d.eof {
+			d.tokenizeErr = terr
+		}
+	} else if !d.eof && len(tokens) != 0 {
+		// the last token may go on in the input not read yet.
+		if last := tokens[len(tokens)-1]; last.Offset+len(last.Raw) == d.bufStart.Offset+len(d.buf) {
+			tokens = tokens[:len(tokens)-1]
+		}
+	}
+	if len(tokens) != 0 {
+		end := tokenEnd(tokens[len(tokens)-1])
+		d.buf = d.buf[end.Offset-d.bufStart.Offset:]
+		d.bufStart = end
+		d.tokens = append(d.tokens, tokens...)
+	}
+	return
+}
+
+// fill reads up to size more bytes of input into the buffer.
+func (d *Decoder) fill(size int) (err error) {
+	if d.readErr != nil {
+		return d.readErr
+	}
+	chunk := make([]byte, size)
+	n, err := d.Reader.Read(chunk)
+	d.buf = append(d.buf, chunk[:n]...)
+	if err == io.EOF {
+		d.eof = true
+		err = nil
+	}
+	d.readErr = err
+	return
+}
+
 func getTagValue(typ string, t Tag) (value string, ok bool) {
 	prefix := typ + "="
 	if strings.HasPrefix(string(t), prefix) {
@@ -94,8 +289,12 @@ func getTagValue(typ string, t Tag) (value string, ok bool) {
 var _ = fmt.Println
 
 type StructuredAST struct {
-	ast   AST
-	types map[string]reflect.Type
+	ast       AST
+	types     map[string]reflect.Type
+	positions *Positions
+
+	disallowDuplicateKeys bool
+	strict                bool
 }
 
 func NewStructuredAST(ast AST) (sa StructuredAST) {
@@ -107,12 +306,143 @@ func NewStructuredAST(ast AST) (sa StructuredAST) {
 }
 
 func (sa StructuredAST) RegisterType(x interface{}) {
-	t := reflect.TypeOf(x)
-	sa.types[t.Name()] = t
+	sa.RegisterTypeAs(reflect.TypeOf(x).Name(), x)
+}
+
+func (sa StructuredAST) RegisterTypeAs(name string, x interface{}) {
+	sa.types[name] = reflect.TypeOf(x)
+}
+
+// isType reports whether {type=name} names typ.
+func (sa StructuredAST) isType(name string, typ reflect.Type) bool {
+	return typeNamed(sa.types, name, typ)
+}
+
+func typeNamed(types map[string]reflect.Type, name string, typ reflect.Type) bool {
+	if registered, ok := types[name]; ok {
+		return registered == typ
+	}
+	return name == typ.Name()
+}
+
+// DisallowDuplicateKeys makes it an error for the AST to give the same key
+// twice when decoding into a map.
+func (sa *StructuredAST) DisallowDuplicateKeys() {
+	sa.disallowDuplicateKeys = true
+}
+
+// Strict turns on strict mode, in which decoding stops at the first problem
+// instead of leaving what it can't decode alone. In strict mode, it is an
+// error for a subtree to be decoded into a struct of a different type than
+// its type= tag names, or into a field that can't hold it, and for a subtree
+// or symbol in a struct's tree to not be decoded into any field.
+func (sa *StructuredAST) Strict() {
+	sa.strict = true
 }
 
 func (sa StructuredAST) Decode(obj interface{}) (err error) {
-	return sa.decode([]Node(sa.ast), reflect.ValueOf(obj))
+	return sa.decode([]Node(sa.ast), reflect.ValueOf(obj), decodePath{})
+}
+
+// A decodePath tracks where decoding is, both in the object and in the AST.
+type decodePath struct {
+	goPath  string
+	astPath []int
+	// parent holds the node being decoded, at the end of astPath.
+	parent []Node
+	// positioned is set when decoding through "{field=.}", into a value
+	// whose Pos and Span fields were already set by its outer subtree.
+	positioned bool
+}
+
+// child is the path to parent[i], which is decoded into the part of the
+// object found by adding goPath.
+func (p decodePath) child(goPath string, parent []Node, i int) decodePath {
+	return decodePath{
+		goPath:  p.goPath + goPath,
+		astPath: append(p.astPath[:len(p.astPath):len(p.astPath)], i),
+		parent:  parent,
+	}
+}
+
+// decodeValue decodes node into v, first allocating a value of the type named
+// by node's type= tag if v is an interface.
+func (sa StructuredAST) decodeValue(node Node, v reflect.Value, path decodePath) (err error) {
+	if v.Kind() != reflect.Interface {
+		return sa.decode(node, v, path)
+	}
+	pv, err := sa.makePointerWithType(node)
+	if err != nil {
+		return sa.errorAt(node, path, err)
+	}
+	// use a pointer if only it has the methods the interface needs.
+	iv := pv.Elem()
+	if !iv.Type().Implements(v.Type()) {
+		if !pv.Type().Implements(v.Type()) {
+			return sa.errorAt(node, path, fmt.Errorf("Type %s does not implement %s.", iv.Type(), v.Type()))
+		}
+		iv = pv
+	}
+	err = sa.decode(node, pv.Elem(), path)
+	v.Set(iv)
+	return
+}
+
+// errorAt wraps err in a DecodeError saying that it happened while decoding
+// node at path, unless it already says where it happened.
+func (sa StructuredAST) errorAt(node Node, path decodePath, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*DecodeError); ok {
+		return err
+	}
+	de := &DecodeError{
+		Path:    path.goPath,
+		ASTPath: path.astPath,
+		Err:     err,
+	}
+	if de.Path == "" {
+		de.Path = "."
+	}
+	var span Span
+	var ok bool
+	if len(path.astPath) == 0 {
+		nodes, _ := node.([]Node)
+		span, ok = sa.positions.Of(nodes)
+	} else {
+		span, ok = sa.positions.OfChild(path.parent, path.astPath[len(path.astPath)-1])
+	}
+	if ok {
+		de.Pos = &span.Start
+	}
+	return de
+}
+
+// unconsumed finds a node that wasn't decoded, but has symbols in it. Literals
+// and tags are only there for the grammar.
+func (sa StructuredAST) unconsumed(nodes []Node, consumed []bool, path decodePath) (err error) {
+	for i, node := range nodes {
+		if !consumed[i] && hasSymbols(node) {
+			err = sa.errorAt(node, path.child("", nodes, i), fmt.Errorf("%v was not decoded into any field.", node))
+			return
+		}
+	}
+	return
+}
+
+func hasSymbols(node Node) bool {
+	switch node := node.(type) {
+	case SymbolText:
+		return true
+	case []Node:
+		for _, child := range node {
+			if hasSymbols(child) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 var dtr = debugtags.Tracer{Enabled: false}
@@ -121,11 +451,12 @@ func SetDTr(enabled bool) {
 	dtr.Enabled = enabled
 }
 
-func (sa StructuredAST) decode(node Node, v reflect.Value) (err error) {
+func (sa StructuredAST) decode(node Node, v reflect.Value, path decodePath) (err error) {
 	name := fmt.Sprintf("%T", v.Interface())
 	dtr.In(name, node)
 	defer func() {
 		dtr.Out(name, v.Interface())
+		err = sa.errorAt(node, path, err)
 	}()
 
 	typ := v.Type()
@@ -134,106 +465,135 @@ func (sa StructuredAST) decode(node Node, v reflect.Value) (err error) {
 	if typ.Kind() == reflect.Ptr {
 		// but first check if it's nil and, if so, allocate
 		if v.IsNil() {
-			v.Elem().Set(reflect.New(typ.Elem()))
+			v.Set(reflect.New(typ.Elem()))
 		}
 		v = v.Elem()
 		typ = typ.Elem()
 	}
 
+	// let the value decode itself, if it knows how. This includes big.Int and
+	// big.Float, which are TextUnmarshalers.
+	if handled, uerr := sa.unmarshal(node, v); handled {
+		err = uerr
+		return
+	}
+
 	switch typ.Kind() {
 	// populate struct fields
 	case reflect.Struct:
 		// we've got a struct pointer - iterate through node looking for field= tags
 		nodes, ok := node.([]Node)
 		if !ok {
-			err = errors.New("Need to populate struct via []Node with tags.")
+			err = mismatch("Need to populate struct via []Node with tags.")
 			return
 		}
+		if !path.positioned {
+			sa.setPositions(v, nodes)
+		}
+		consumed := make([]bool, len(nodes))
 		for i := range nodes {
 			if tag, ok := nodes[i].(Tag); ok {
 				if typName, isType := getTagValue("type", tag); isType {
-					if typName != typ.Name() {
+					if !sa.isType(typName, typ) && sa.strict {
 						err = fmt.Errorf("AST wants type %q, being decoded to type %q.", typName, typ.Name())
+						return
 					}
 				}
 
 				if name, isField := getTagValue("field", tag); isField {
 					// if we have a field tag, that indicates that the next node should be decided into the field with the given name.
+					if i+1 == len(nodes) {
+						err = fmt.Errorf("Nothing to decode into field %q.", name)
+						return
+					}
 					var fv reflect.Value
-					fv, err = getField(v, name)
+					var fieldPath string
+					fv, fieldPath, err = getField(v, name, true)
 					if err != nil {
 						return
 					}
+					consumed[i+1] = true
 
-					if fv.Type().Kind() == reflect.Interface {
-						//dtr.Println("field of interface")
-						var pv reflect.Value
-						pv, err = sa.makePointerWithType(nodes[i+1])
-						if err != nil {
-							return
-						}
-						err = sa.decode(nodes[i+1], pv.Elem())
-						fv.Set(pv.Elem())
-						if err != nil {
-							return
-						}
-					} else {
-						sa.decode(nodes[i+1], fv)
+					fpath := path.child(fieldPath, nodes, i+1)
+					fpath.positioned = name == "."
+					err = sa.decodeValue(nodes[i+1], fv, fpath)
+					// outside of strict mode, a field that can't hold its
+					// subtree is left as is, but a value that doesn't fit,
+					// like an int8 given 300, is still an error.
+					if err != nil && (sa.strict || fv.Kind() == reflect.Interface || !isMismatch(err)) {
+						return
 					}
+					err = nil
 				}
 			}
 		}
+		if sa.strict {
+			err = sa.unconsumed(nodes, consumed, path)
+		}
 
 	// map things into slices
 	case reflect.Slice:
 		//fmt.Printf("Going into %s is\n", typ.Elem().Name())
 		//printNode(node, 0)
-		isInterfaceSlice := typ.Elem().Kind() == reflect.Interface
-		// if isInterfaceSlice {
-		// 	dtr.Println("slice of interface")
-		// }
 		nodes, ok := node.([]Node)
 		if !ok {
-			err = errors.New("Need to populate slice via []Node.")
+			err = mismatch("Need to populate slice via []Node.")
 			return
 		}
-		for _, n := range nodes {
+		for i, n := range nodes {
 			// create an addressable value to put in the slice
 			ev := reflect.New(typ.Elem()).Elem()
-			if isInterfaceSlice {
-				var pv reflect.Value
-				pv, err = sa.makePointerWithType(n)
-				if err != nil {
-					return
-				}
-				err = sa.decode(n, pv.Elem())
-				ev.Set(pv.Elem())
-				if err != nil {
-					return
-				}
-			} else {
-				// temporarily shadow ev, leaving the thing to be put back in the slice alone.
-				ev := ev
-				for ev.Type().Kind() == reflect.Ptr {
-					pv := ev
-					newthing := reflect.New(pv.Type().Elem())
-					pv.Set(newthing)
-					ev = pv.Elem()
-				}
-				err = sa.decode(n, ev)
-				if err != nil {
-					return
-				}
+			// decode through any pointers, leaving the thing to be put back in the slice alone.
+			dv := ev
+			for dv.Type().Kind() == reflect.Ptr {
+				dv.Set(reflect.New(dv.Type().Elem()))
+				dv = dv.Elem()
+			}
+			err = sa.decodeValue(n, dv, path.child(fmt.Sprintf("[%d]", v.Len()), nodes, i))
+			if err != nil {
+				return
 			}
 			// this is how append looks w/ reflect
 			v.Set(reflect.Append(v, ev))
 		}
 
+	// fill maps with entries, each a []Node with {key} and {value} tags
+	case reflect.Map:
+		nodes, ok := node.([]Node)
+		if !ok {
+			err = mismatch("Need to populate map via []Node.")
+			return
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(typ))
+		}
+		for i, n := range nodes {
+			kv := reflect.New(typ.Key()).Elem()
+			ev := reflect.New(typ.Elem()).Elem()
+			entryPath := path.child("", nodes, i)
+			if err = sa.decodeEntry(n, kv, ev, entryPath); err != nil {
+				return
+			}
+			if !canBeKey(kv) {
+				keyType := kv.Type()
+				if kv.Kind() == reflect.Interface {
+					keyType = kv.Elem().Type()
+				}
+				err = sa.errorAt(n, entryPath, fmt.Errorf("Map key of type %s is not comparable.", keyType))
+				return
+			}
+			if sa.disallowDuplicateKeys && v.MapIndex(kv).IsValid() {
+				err = sa.errorAt(n, entryPath, fmt.Errorf("Duplicate key %v.", kv.Interface()))
+				return
+			}
+			v.SetMapIndex(kv, ev)
+		}
+
 	// symbols, literals, and tags go into strings
 	case reflect.String:
 		s := ""
 		if s, err = getString(node); err != nil {
-			err = errors.New("Trying to store invalid type into string field.")
+			err = mismatch("Trying to store invalid type into string field.")
 			return
 		}
 		v.SetString(s)
@@ -242,11 +602,11 @@ func (sa StructuredAST) decode(node Node, v reflect.Value) (err error) {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		s := ""
 		if s, err = getString(node); err != nil {
-			err = errors.New("Trying to store invalid type into integer field.")
+			err = mismatch("Trying to store invalid type into integer field.")
 			return
 		}
 		var x int64
-		if x, err = strconv.ParseInt(string(s), 0, 64); err != nil {
+		if x, err = strconv.ParseInt(string(s), 0, typ.Bits()); err != nil {
 			return
 		}
 		v.SetInt(x)
@@ -255,22 +615,191 @@ func (sa StructuredAST) decode(node Node, v reflect.Value) (err error) {
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
 		s := ""
 		if s, err = getString(node); err != nil {
-			err = errors.New("Trying to store invalid type into unsigned integer field.")
+			err = mismatch("Trying to store invalid type into unsigned integer field.")
 			return
 		}
 		var x uint64
-		if x, err = strconv.ParseUint(string(s), 0, 64); err != nil {
+		if x, err = strconv.ParseUint(string(s), 0, typ.Bits()); err != nil {
 			return
 		}
 		v.SetUint(x)
 
+	// and floats
+	case reflect.Float32, reflect.Float64:
+		s := ""
+		if s, err = getString(node); err != nil {
+			err = mismatch("Trying to store invalid type into float field.")
+			return
+		}
+		var x float64
+		if x, err = strconv.ParseFloat(s, typ.Bits()); err != nil {
+			return
+		}
+		v.SetFloat(x)
+
+	// and complex numbers, written like 1+2i
+	case reflect.Complex64, reflect.Complex128:
+		s := ""
+		if s, err = getString(node); err != nil {
+			err = mismatch("Trying to store invalid type into complex field.")
+			return
+		}
+		var x complex128
+		if x, err = strconv.ParseComplex(s, typ.Bits()); err != nil {
+			return
+		}
+		v.SetComplex(x)
+
+	case reflect.Bool:
+		s := ""
+		if s, err = getString(node); err != nil {
+			err = mismatch("Trying to store invalid type into bool field.")
+			return
+		}
+		var x bool
+		if x, err = strconv.ParseBool(s); err != nil {
+			return
+		}
+		v.SetBool(x)
+
 	default:
-		err = fmt.Errorf("Unanticipated type: %s.", typ.Name())
+		err = mismatch(fmt.Sprintf("Unanticipated type: %s.", typ.Name()))
+	}
+
+	return
+}
+
+// A mismatch is an error from a node not having the shape of what it is being
+// decoded into, like a subtree given to an int.
+type mismatch string
+
+func (m mismatch) Error() string {
+	return string(m)
+}
+
+func isMismatch(err error) bool {
+	if de, ok := err.(*DecodeError); ok {
+		err = de.Err
+	}
+	_, ok := err.(mismatch)
+	return ok
+}
+
+// decodeEntry decodes the map entry node, which is like a struct with only
+// the fields {key} and {value}. Without a {value}, the entry gets the zero
+// value.
+func (sa StructuredAST) decodeEntry(node Node, kv, ev reflect.Value, path decodePath) (err error) {
+	nodes, ok := node.([]Node)
+	if !ok {
+		err = sa.errorAt(node, path, mismatch("Need to populate map entry via []Node with tags."))
+		return
+	}
+	consumed := make([]bool, len(nodes))
+	hasKey := false
+	for i := 0; i+1 < len(nodes); i++ {
+		switch nodes[i] {
+		case Tag("key"):
+			err = sa.decodeValue(nodes[i+1], kv, path.child("{key}", nodes, i+1))
+			hasKey = true
+		case Tag("value"):
+			err = sa.decodeValue(nodes[i+1], ev, path.child(fmt.Sprintf("[%#v]", kv.Interface()), nodes, i+1))
+		default:
+			continue
+		}
+		if err != nil {
+			return
+		}
+		consumed[i+1] = true
+	}
+	if !hasKey {
+		err = sa.errorAt(node, path, mismatch("Map entry has no {key} tag."))
+	} else if sa.strict {
+		err = sa.unconsumed(nodes, consumed, path)
+	}
+	return
+}
+
+// canBeKey reports whether v can be used as a map key without panicking. A
+// key type can be comparable while an interface inside it holds a value that
+// isn't, like a slice.
+func canBeKey(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Interface:
+		return v.IsNil() || canBeKey(v.Elem())
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !canBeKey(v.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if !canBeKey(v.Index(i)) {
+				return false
+			}
+		}
+		return true
 	}
+	return v.Type().Comparable()
+}
+
+// An Unmarshaler decodes itself from the subtree that would otherwise be
+// decoded into it. A leaf is passed as a subtree containing only that leaf.
+type Unmarshaler interface {
+	UnmarshalGopp(nodes []Node) error
+}
 
+// unmarshal has v decode itself from node, if it is an Unmarshaler or an
+// encoding.TextUnmarshaler. A TextUnmarshaler is given the text of a leaf.
+func (sa StructuredAST) unmarshal(node Node, v reflect.Value) (handled bool, err error) {
+	if !v.CanAddr() {
+		return
+	}
+	switch u := v.Addr().Interface().(type) {
+	case Unmarshaler:
+		handled = true
+		nodes, ok := node.([]Node)
+		if !ok {
+			nodes = []Node{node}
+		}
+		err = u.UnmarshalGopp(nodes)
+	case encoding.TextUnmarshaler:
+		handled = true
+		var s string
+		if s, err = getString(node); err != nil {
+			err = mismatch(fmt.Sprintf("Trying to store invalid type into %s.", v.Type()))
+			return
+		}
+		err = u.UnmarshalText([]byte(s))
+	}
 	return
 }
 
+var posType = reflect.TypeOf(Pos{})
+var spanType = reflect.TypeOf(Span{})
+
+// setPositions fills in the Pos and Span fields of the struct v with where
+// nodes came from in the document.
+func (sa StructuredAST) setPositions(v reflect.Value, nodes []Node) {
+	span, ok := sa.positions.Of(nodes)
+	if !ok {
+		return
+	}
+	for i := 0; i < v.NumField(); i++ {
+		fv := v.Field(i)
+		if !fv.CanSet() {
+			continue
+		}
+		switch fv.Type() {
+		case posType:
+			fv.Set(reflect.ValueOf(span.Start))
+		case spanType:
+			fv.Set(reflect.ValueOf(span))
+		}
+	}
+}
+
 func (sa StructuredAST) makePointerWithType(node Node) (pointer reflect.Value, err error) {
 	var ntag Tag
 	nodes, ok := node.([]Node)
@@ -285,12 +814,19 @@ func (sa StructuredAST) makePointerWithType(node Node) (pointer reflect.Value, e
 		return
 	}
 	typeName := ntag[len("type="):]
-	typ := sa.types[string(typeName)]
+	typ, ok := sa.types[string(typeName)]
+	if !ok {
+		err = fmt.Errorf("Type %q has not been registered.", string(typeName))
+		return
+	}
 	pointer = reflect.New(typ)
 	return
 }
 
-func getField(v reflect.Value, field string) (fv reflect.Value, err error) {
+// getField finds the field of v that {field=X} names, and the path to it from
+// v, which is like ".Field", or ".Embedded.Field" for a promoted field. If
+// alloc is set, nil embedded pointers on the way to it are allocated.
+func getField(v reflect.Value, field string, alloc bool) (fv reflect.Value, path string, err error) {
 	defer func() {
 		if recover() != nil {
 			err = fmt.Errorf("Type %s has no field named %q.", v.Type().Name(), field)
@@ -299,12 +835,131 @@ func getField(v reflect.Value, field string) (fv reflect.Value, err error) {
 	if field == "." {
 		// . means to store the next level deeper in the same value
 		fv = v
-	} else {
-		fv = v.FieldByName(field)
+		return
+	}
+	for _, f := range goppFields(v.Type()) {
+		if f.name != field {
+			continue
+		}
+		if fv = fieldByIndex(v, f.index, alloc); !fv.IsValid() {
+			err = fmt.Errorf("Field %q of type %s is inside a nil embedded struct.", field, v.Type().Name())
+		}
+		path = f.path
+		return
 	}
+	err = fmt.Errorf("Type %s has no field named %q.", v.Type().Name(), field)
 	return
 }
 
+// A goppField is a field that {field=X} can name.
+type goppField struct {
+	name  string
+	path  string
+	index []int
+	// embedded is set for an embedded struct, whose fields are promoted.
+	embedded bool
+	tagged   bool
+}
+
+// goppFields lists the fields of the struct type typ that {field=X} can name.
+// Like encoding/json, a gopp:"name" struct tag renames a field, gopp:"-"
+// hides it, and the fields of embedded structs are promoted. A field hides
+// deeper ones with the same name, and of several at the same depth, only a
+// tagged one is used, and only if it is the only one tagged.
+func goppFields(typ reflect.Type) (fields []goppField) {
+	type embedded struct {
+		typ   reflect.Type
+		path  string
+		index []int
+	}
+	current := []embedded{{typ: typ}}
+	visited := map[reflect.Type]bool{typ: true}
+	hidden := map[string]bool{}
+	for len(current) != 0 {
+		var next []embedded
+		var level []goppField
+		for _, e := range current {
+			for i := 0; i < e.typ.NumField(); i++ {
+				sf := e.typ.Field(i)
+				name := goppFieldName(sf)
+				if name == "-" {
+					continue
+				}
+				f := goppField{
+					name:   name,
+					path:   e.path + "." + sf.Name,
+					index:  append(e.index[:len(e.index):len(e.index)], i),
+					tagged: name != "",
+				}
+				ft := sf.Type
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if sf.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+					if !visited[ft] {
+						visited[ft] = true
+						next = append(next, embedded{ft, f.path, f.index})
+					}
+					f.embedded = true
+				}
+				if sf.PkgPath != "" {
+					continue
+				}
+				if f.name == "" {
+					f.name = sf.Name
+				}
+				level = append(level, f)
+			}
+		}
+		count, tagged := map[string]int{}, map[string]int{}
+		for _, f := range level {
+			count[f.name]++
+			if f.tagged {
+				tagged[f.name]++
+			}
+		}
+		for _, f := range level {
+			if !hidden[f.name] && (count[f.name] == 1 || f.tagged && tagged[f.name] == 1) {
+				fields = append(fields, f)
+			}
+		}
+		for name := range count {
+			hidden[name] = true
+		}
+		current = next
+	}
+	return
+}
+
+// fieldByIndex is like v.FieldByIndex, but goes through nil embedded pointers
+// by allocating them if alloc is set, and otherwise returns the zero Value.
+func fieldByIndex(v reflect.Value, index []int, alloc bool) (fv reflect.Value) {
+	fv = v
+	for i, x := range index {
+		if i != 0 && fv.Kind() == reflect.Ptr {
+			if fv.IsNil() {
+				if !alloc || !fv.CanSet() {
+					return reflect.Value{}
+				}
+				fv.Set(reflect.New(fv.Type().Elem()))
+			}
+			fv = fv.Elem()
+		}
+		fv = fv.Field(x)
+	}
+	return
+}
+
+// goppFieldName returns the name given to a field by its gopp struct tag,
+// which is "-" for a hidden field.
+func goppFieldName(sf reflect.StructField) string {
+	name := sf.Tag.Get("gopp")
+	if i := strings.Index(name, ","); i != -1 {
+		name = name[:i]
+	}
+	return name
+}
+
 func getString(node Node) (s string, err error) {
 	switch nn := node.(type) {
 	case SymbolText:
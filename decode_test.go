@@ -5,8 +5,15 @@
 package gopp_test
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"reflect"
 	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/skelterjohn/gopp"
 )
@@ -47,3 +54,660 @@ dig = /(\d+)/
 		}
 	}
 }
+
+type PosNode struct {
+	Val  string
+	Pos  gopp.Pos
+	Span gopp.Span
+}
+
+type PosNodes struct {
+	Kids []PosNode
+}
+
+func TestDecodePositions(t *testing.T) {
+	grammar := `
+Start => {field=Kids} <<Node>>*
+Node => {field=Val} <dig> ','
+
+dig = /(\d+)/
+`
+	df, err := gopp.NewDecoderFactory(grammar, "Start")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	dec := df.NewDecoder(strings.NewReader("1,42,7,"))
+	out := &PosNodes{}
+	err = dec.Decode(out)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expected := []PosNode{
+		{"1", gopp.Pos{0, 0, 0}, gopp.Span{gopp.Pos{0, 0, 0}, gopp.Pos{0, 2, 2}}},
+		{"42", gopp.Pos{0, 2, 2}, gopp.Span{gopp.Pos{0, 2, 2}, gopp.Pos{0, 5, 5}}},
+		{"7", gopp.Pos{0, 5, 5}, gopp.Span{gopp.Pos{0, 5, 5}, gopp.Pos{0, 7, 7}}},
+	}
+	if !reflect.DeepEqual(out.Kids, expected) {
+		t.Errorf("Expected %v, got %v.", expected, out.Kids)
+	}
+}
+
+func TestDecodePositionsThroughSelf(t *testing.T) {
+	grammar := `
+Start => 'let' {field=.} <<Inner>>
+Inner => {field=Val} <dig>
+
+dig = /(\d+)/
+`
+	df, err := gopp.NewDecoderFactory(grammar, "Start")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// the value starts at 0:0, which must not be mistaken for being unset.
+	dec := df.NewDecoder(strings.NewReader("let42"))
+	out := PosNode{}
+	err = dec.Decode(&out)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expected := PosNode{"42", gopp.Pos{0, 0, 0}, gopp.Span{gopp.Pos{0, 0, 0}, gopp.Pos{0, 5, 5}}}
+	if out != expected {
+		t.Errorf("Expected %v, got %v.", expected, out)
+	}
+}
+
+func TestDecodeStream(t *testing.T) {
+	grammar := `
+ignore: /^\s+/
+Record => {field=Val} <dig> ';'
+
+dig = /(\d+)/
+`
+	df, err := gopp.NewDecoderFactory(grammar, "Record")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// reading a byte at a time splits tokens between reads.
+	dec := df.NewDecoder(iotest.OneByteReader(strings.NewReader("1;\n 42 ;\n7;\n\n")))
+	expected := []PosNode{
+		{"1", gopp.Pos{0, 0, 0}, gopp.Span{gopp.Pos{0, 0, 0}, gopp.Pos{0, 2, 2}}},
+		{"42", gopp.Pos{1, 1, 4}, gopp.Span{gopp.Pos{1, 1, 4}, gopp.Pos{1, 5, 8}}},
+		{"7", gopp.Pos{2, 0, 9}, gopp.Span{gopp.Pos{2, 0, 9}, gopp.Pos{2, 2, 11}}},
+	}
+	var out []PosNode
+	for dec.More() {
+		var rec PosNode
+		err = dec.Decode(&rec)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		out = append(out, rec)
+	}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("Expected %v, got %v.", expected, out)
+	}
+	if err = dec.Decode(&PosNode{}); err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v.", err)
+	}
+
+	dec = df.NewDecoder(strings.NewReader("1;\n2\n3;"))
+	if err = dec.Decode(&PosNode{}); err != nil {
+		t.Error(err)
+	}
+	expectedErr := "expected ';' but found <dig> '3' at 2:0"
+	if err = dec.Decode(&PosNode{}); err == nil || err.Error() != expectedErr {
+		t.Errorf("Expected error %q, got %v.", expectedErr, err)
+	}
+	if dec.More() {
+		t.Error("Expected no more after an error.")
+	}
+
+	// text that can't be tokenized is only a problem once it's reached.
+	dec = df.NewDecoder(strings.NewReader("1;\n2;\n?"))
+	out = nil
+	for dec.More() {
+		var rec PosNode
+		if err = dec.Decode(&rec); err != nil {
+			break
+		}
+		out = append(out, rec)
+	}
+	if len(out) != 2 || out[0].Val != "1" || out[1].Val != "2" {
+		t.Errorf("Expected records 1 and 2, got %v.", out)
+	}
+	if _, ok := err.(*gopp.TokenizeError); !ok {
+		t.Errorf("Expected a *gopp.TokenizeError, got %T: %v.", err, err)
+	}
+}
+
+type Color int
+
+const (
+	Red Color = iota
+	Green
+)
+
+func (c *Color) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "red":
+		*c = Red
+	case "green":
+		*c = Green
+	default:
+		return fmt.Errorf("Unknown color %q.", text)
+	}
+	return nil
+}
+
+// Range decodes itself from a subtree like [SymbolText Literal SymbolText].
+type Range struct {
+	From, To string
+}
+
+func (r *Range) UnmarshalGopp(nodes []gopp.Node) error {
+	var texts []string
+	for _, n := range nodes {
+		if st, ok := n.(gopp.SymbolText); ok {
+			texts = append(texts, st.Text)
+		}
+	}
+	if len(texts) != 2 {
+		return fmt.Errorf("Expected two ends of a range, got %d.", len(texts))
+	}
+	r.From, r.To = texts[0], texts[1]
+	return nil
+}
+
+type Host struct {
+	Addr   net.IP
+	Color  *Color
+	Ports  Range
+	Colors []Color
+}
+
+func TestDecodeUnmarshalers(t *testing.T) {
+	grammar := `
+ignore: /^\s+/
+Start => {field=Addr} <addr> {field=Color} <word> {field=Ports} <<Range>> {field=Colors} <word>*
+Range => <dig> '-' <dig>
+
+addr = /(\d+\.\d+\.\d+\.\d+)/
+dig = /(\d+)/
+word = /([a-z]+)/
+`
+	df, err := gopp.NewDecoderFactory(grammar, "Start")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	dec := df.NewDecoder(strings.NewReader("10.0.0.1 green 80-90 red green"))
+	var h Host
+	err = dec.Decode(&h)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	green := Green
+	expected := Host{
+		Addr:   net.IPv4(10, 0, 0, 1),
+		Color:  &green,
+		Ports:  Range{"80", "90"},
+		Colors: []Color{Red, Green},
+	}
+	if !reflect.DeepEqual(h, expected) {
+		t.Errorf("Expected %+v, got %+v.", expected, h)
+	}
+
+	var colors []Color
+	sa := gopp.NewStructuredAST(gopp.AST{gopp.SymbolText{Type: "word", Text: "blue"}})
+	err = sa.Decode(&colors)
+	if err == nil || err.Error() != `[0]: Unknown color "blue".` {
+		t.Errorf("Expected an unknown color error, got %v.", err)
+	}
+
+	// errors from fields are returned too, even outside of strict mode.
+	fieldCases := []struct {
+		ast      gopp.AST
+		expected string
+	}{
+		{
+			gopp.AST{gopp.Tag("field=Addr"), gopp.SymbolText{Type: "addr", Text: "notanip"}},
+			".Addr: invalid IP address: notanip",
+		},
+		{
+			gopp.AST{gopp.Tag("field=Ports"), []gopp.Node{gopp.SymbolText{Type: "dig", Text: "80"}}},
+			".Ports: Expected two ends of a range, got 1.",
+		},
+	}
+	for _, c := range fieldCases {
+		err = gopp.NewStructuredAST(c.ast).Decode(&Host{})
+		if err == nil || err.Error() != c.expected {
+			t.Errorf("Expected error %q, got %v.", c.expected, err)
+		}
+	}
+	// and the Unmarshaler's own error can be reached.
+	err = gopp.NewStructuredAST(fieldCases[0].ast).Decode(&Host{})
+	var ipErr *net.ParseError
+	if !errors.As(err, &ipErr) || ipErr.Text != "notanip" {
+		t.Errorf("Expected a *net.ParseError, got %T: %v.", err, err)
+	}
+	// but a leaf that can't be given to UnmarshalText is left alone.
+	sa = gopp.NewStructuredAST(gopp.AST{gopp.Tag("field=Addr"), []gopp.Node{gopp.SymbolText{Type: "addr", Text: "10.0.0.1"}}})
+	if err = sa.Decode(&Host{}); err != nil {
+		t.Error(err)
+	}
+}
+
+type Numbers struct {
+	I8   int8
+	U16  uint16
+	F32  float32
+	F64  float64
+	C    complex128
+	B    bool
+	BigI *big.Int
+	BigF *big.Float
+}
+
+func TestDecodeNumbers(t *testing.T) {
+	grammar := `
+ignore: /^\s+/
+Start => {field=I8} <n> {field=U16} <n> {field=F32} <n> {field=F64} <n> {field=C} <n> {field=B} <n> {field=BigI} <n> {field=BigF} <n>
+
+n = /([^\s]+)/
+`
+	df, err := gopp.NewDecoderFactory(grammar, "Start")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	dec := df.NewDecoder(strings.NewReader("-12 0xffff 1.5 -2e-3 1+2i true 123456789012345678901234567890 0.25"))
+	var out Numbers
+	err = dec.Decode(&out)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if out.I8 != -12 || out.U16 != 0xffff || out.F32 != 1.5 || out.F64 != -2e-3 || out.C != 1+2i || !out.B {
+		t.Errorf("Got %+v.", out)
+	}
+	if out.BigI == nil || out.BigI.String() != "123456789012345678901234567890" {
+		t.Errorf("Got big int %v.", out.BigI)
+	}
+	if out.BigF == nil || out.BigF.String() != "0.25" {
+		t.Errorf("Got big float %v.", out.BigF)
+	}
+
+	overflows := []struct {
+		text string
+		into interface{}
+	}{
+		{"128", &[]int8{}},
+		{"65536", &[]uint16{}},
+		{"1e39", &[]float32{}},
+		{"1e39+1i", &[]complex64{}},
+		{"yes", &[]bool{}},
+	}
+	for _, o := range overflows {
+		sa := gopp.NewStructuredAST(gopp.AST{gopp.SymbolText{Type: "n", Text: o.text}})
+		if err = sa.Decode(o.into); err == nil {
+			t.Errorf("Expected an error decoding %q into %T.", o.text, o.into)
+		}
+	}
+
+	// fields are checked the same way, even outside of strict mode.
+	sa := gopp.NewStructuredAST(gopp.AST{gopp.Tag("field=I8"), gopp.SymbolText{Type: "n", Text: "300"}})
+	out = Numbers{}
+	expected := `.I8: strconv.ParseInt: parsing "300": value out of range`
+	if err = sa.Decode(&out); err == nil || err.Error() != expected {
+		t.Errorf("Expected error %q, got %v.", expected, err)
+	}
+}
+
+type Env struct {
+	Vars map[string]int
+}
+
+func TestDecodeMap(t *testing.T) {
+	grammar := `
+ignore: /^\s+/
+Start => {field=Vars} <<Var>>*
+Var => {key} <word> '=' {value} <dig>
+
+word = /([a-z]+)/
+dig = /(\d+)/
+`
+	df, err := gopp.NewDecoderFactory(grammar, "Start")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	dec := df.NewDecoder(strings.NewReader("a=1 b=2 a=3"))
+	var env Env
+	err = dec.Decode(&env)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expected := map[string]int{"a": 3, "b": 2}
+	if !reflect.DeepEqual(env.Vars, expected) {
+		t.Errorf("Expected %v, got %v.", expected, env.Vars)
+	}
+
+	sa := gopp.NewStructuredAST(gopp.AST{
+		[]gopp.Node{gopp.Tag("key"), gopp.SymbolText{Type: "word", Text: "a"}, gopp.Tag("value"), gopp.SymbolText{Type: "dig", Text: "1"}},
+		[]gopp.Node{gopp.Tag("key"), gopp.SymbolText{Type: "word", Text: "a"}, gopp.Tag("value"), gopp.SymbolText{Type: "dig", Text: "2"}},
+	})
+	var vars map[string]int
+	if err = sa.Decode(&vars); err != nil {
+		t.Error(err)
+	}
+	sa.DisallowDuplicateKeys()
+	vars = nil
+	if err = sa.Decode(&vars); err == nil || err.Error() != ".: Duplicate key a." {
+		t.Errorf("Expected a duplicate key error, got %v.", err)
+	}
+
+	// a key can hold a value that can't be hashed.
+	sa = gopp.NewStructuredAST(gopp.AST{
+		[]gopp.Node{gopp.Tag("key"), []gopp.Node{gopp.Tag("type=WordList"), gopp.Tag("field=Words"), []gopp.Node{gopp.SymbolText{Type: "word", Text: "a"}}}, gopp.Tag("value"), gopp.SymbolText{Type: "dig", Text: "1"}},
+	})
+	sa.RegisterType(WordList{})
+	var byList map[interface{}]int
+	if err = sa.Decode(&byList); err == nil || err.Error() != ".: Map key of type gopp_test.WordList is not comparable." {
+		t.Errorf("Expected a key that isn't comparable, got %v.", err)
+	}
+}
+
+type WordList struct {
+	Words []string
+}
+
+type Func struct {
+	Name       string
+	ReturnType string `gopp:"return_type"`
+	Body       string `gopp:"-"`
+}
+
+func TestDecodeStructTags(t *testing.T) {
+	grammar := `
+ignore: /^\s+/
+Start => {field=Name} <word> {field=return_type} <word> [{field=Body} <word>]
+
+word = /([a-z]+)/
+`
+	df, err := gopp.NewDecoderFactory(grammar, "Start")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	dec := df.NewDecoder(strings.NewReader("main int"))
+	var f Func
+	err = dec.Decode(&f)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expected := Func{Name: "main", ReturnType: "int"}
+	if f != expected {
+		t.Errorf("Expected %+v, got %+v.", expected, f)
+	}
+
+	dec = df.NewDecoder(strings.NewReader("main int body"))
+	err = dec.Decode(&Func{})
+	if err == nil || err.Error() != `. at 0:0: Type Func has no field named "Body".` {
+		t.Errorf("Expected the hidden field to be missing, got %v.", err)
+	}
+
+	// tags on fields promoted from embedded structs are found too.
+	df, err = gopp.NewDecoderFactory(methodgopp, "Start")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	dec = df.NewDecoder(strings.NewReader("t main int"))
+	var m Method
+	err = dec.Decode(&m)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expectedMethod := Method{Named{"main"}, &Returns{"int"}, "t"}
+	if !reflect.DeepEqual(m, expectedMethod) {
+		t.Errorf("Expected %+v, got %+v.", expectedMethod, m)
+	}
+}
+
+const methodgopp = `
+ignore: /^\s+/
+Start => {field=Recv} <word> {field=name} <word> {field=return_type} <word>
+
+word = /([a-z]+)/
+`
+
+type Named struct {
+	Name string `gopp:"name"`
+}
+
+type Returns struct {
+	ReturnType string `gopp:"return_type"`
+}
+
+type Method struct {
+	Named
+	*Returns
+	Recv string
+}
+
+type Shape interface{}
+
+type Circle struct {
+	Radius int
+}
+
+type Square struct {
+	Side int
+}
+
+type Drawing struct {
+	Name   string
+	Shapes []Shape
+}
+
+func TestDecodeStrict(t *testing.T) {
+	grammar := `
+ignore: /^\s+/
+Start => {field=Name} <word> {field=Shapes} <<Shape>>*
+Shape => {type=Circle} 'circle' {field=Radius} <dig>
+Shape => {type=Square} 'square' {field=Side} <dig>
+Shape => {type=Circle} 'dot' <dig>
+Shape => {type=Triangle} 'triangle' {field=Side} <dig>
+Shape => {type=Square} 'rect' {field=Side} <dig> {field=Height} <dig>
+Shape => {type=Square} 'big' {field=Side} <word>
+Shape => {type=Square} 'box' {field=Side} <<Size>>
+Size => <dig> '*' <dig>
+
+word = /([a-z]+)/
+dig = /(\d+)/
+`
+	df, err := gopp.NewDecoderFactory(grammar, "Start")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	df.RegisterType(Circle{})
+	df.RegisterType(Square{})
+
+	cases := []struct {
+		document string
+		err      string
+	}{
+		{"pic circle 1 square 2", ""},
+		{"pic circle 1 dot 2", `.Shapes[1] at 0:17: <dig:"2"> was not decoded into any field.`},
+		{"pic triangle 3", `.Shapes[0] at 0:4: Type "Triangle" has not been registered.`},
+		{"pic square 1 rect 2 3", `.Shapes[1] at 0:13: Type Square has no field named "Height".`},
+		{"pic big x", `.Shapes[0].Side at 0:8: strconv.ParseInt: parsing "x": invalid syntax`},
+	}
+	for _, c := range cases {
+		dec := df.NewDecoder(strings.NewReader(c.document))
+		dec.Strict()
+		err = dec.Decode(&Drawing{})
+		if c.err == "" {
+			if err != nil {
+				t.Errorf("With %q, got error %v.", c.document, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != c.err {
+			t.Errorf("With %q, expected error %q, got %v.", c.document, c.err, err)
+		}
+	}
+
+	sa := gopp.NewStructuredAST(gopp.AST{gopp.Tag("type=Circle"), gopp.Tag("field=Side"), gopp.SymbolText{Type: "dig", Text: "1"}})
+	sa.Strict()
+	err = sa.Decode(&Square{})
+	expected := `.: AST wants type "Circle", being decoded to type "Square".`
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected error %q, got %v.", expected, err)
+	}
+
+	// without strict mode, a field that can't hold its subtree is skipped.
+	dec := df.NewDecoder(strings.NewReader("pic box 2*3"))
+	var d Drawing
+	err = dec.Decode(&d)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(d.Shapes) != 1 || d.Shapes[0] != (Square{}) {
+		t.Errorf("Expected an empty square, got %v.", d.Shapes)
+	}
+	// but text that doesn't parse as the field's type is still an error.
+	dec = df.NewDecoder(strings.NewReader("pic big x"))
+	expected = `.Shapes[0].Side at 0:8: strconv.ParseInt: parsing "x": invalid syntax`
+	if err = dec.Decode(&Drawing{}); err == nil || err.Error() != expected {
+		t.Errorf("Expected error %q, got %v.", expected, err)
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	grammar := `
+ignore: /^\s+/
+Start => {field=Name} <word> {field=Shapes} <<Shape>>*
+Shape => {type=Circle} 'circle' {field=Radius} <n>
+Shape => {type=Square} 'square' {field=Side} <n>
+
+word = /([a-z]+)/
+n = /(\d+[a-z]*)/
+`
+	df, err := gopp.NewDecoderFactory(grammar, "Start")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	df.RegisterType(Circle{})
+	df.RegisterType(Square{})
+
+	document := "pic\n  circle 1\n  square 2x\n"
+	dec := df.NewDecoder(strings.NewReader(document))
+	dec.Strict()
+	err = dec.Decode(&Drawing{})
+	de, ok := err.(*gopp.DecodeError)
+	if !ok {
+		t.Errorf("Expected a *gopp.DecodeError, got %T: %v.", err, err)
+		return
+	}
+	if de.Path != ".Shapes[1].Side" {
+		t.Errorf("Expected path %q, got %q.", ".Shapes[1].Side", de.Path)
+	}
+	// the AST is [Name word Shapes [[Circle ...] [type=Square 'square' field=Side 2x]]].
+	if astPath := []int{3, 1, 3}; !reflect.DeepEqual(de.ASTPath, astPath) {
+		t.Errorf("Expected AST path %v, got %v.", astPath, de.ASTPath)
+	}
+	if pos := (gopp.Pos{2, 9, 24}); de.Pos == nil || *de.Pos != pos {
+		t.Errorf("Expected position %v, got %v.", pos, de.Pos)
+	}
+	expected := err.Error() + `
+1 | pic
+2 |   circle 1
+3 |   square 2x
+  |          ^
+4 |
+`
+	if rendered := gopp.RenderError([]byte(document), err); rendered != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, rendered)
+	}
+}
+
+type Areaer interface {
+	Area() int
+}
+
+type Rect struct {
+	W, H int
+}
+
+func (r Rect) Area() int {
+	return r.W * r.H
+}
+
+type Disk struct {
+	R int
+}
+
+func (d *Disk) Area() int {
+	return 3 * d.R * d.R
+}
+
+type Label struct {
+	Text string
+}
+
+type Plan struct {
+	Parts []Areaer
+}
+
+func TestRegisterTypeAs(t *testing.T) {
+	grammar := `
+ignore: /^\s+/
+Start => {field=Parts} <<Part>>*
+Part => {type=geo.Rect} 'rect' {field=W} <n> {field=H} <n>
+Part => {type=geo.Disk} 'disk' {field=R} <n>
+Part => {type=Label} 'label' {field=Text} <n>
+
+n = /(\d+)/
+`
+	df, err := gopp.NewDecoderFactory(grammar, "Start")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	df.RegisterTypeAs("geo.Rect", Rect{})
+	df.RegisterTypeAs("geo.Disk", Disk{})
+	df.RegisterType(Label{})
+
+	dec := df.NewDecoder(strings.NewReader("rect 2 3 disk 1"))
+	var p Plan
+	err = dec.Decode(&p)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expected := []Areaer{Rect{2, 3}, &Disk{1}}
+	if !reflect.DeepEqual(p.Parts, expected) {
+		t.Errorf("Expected %v, got %v.", expected, p.Parts)
+	}
+
+	dec = df.NewDecoder(strings.NewReader("rect 2 3 label 4"))
+	dec.Strict()
+	err = dec.Decode(&Plan{})
+	expectedErr := ".Parts[1] at 0:9: Type gopp_test.Label does not implement gopp_test.Areaer."
+	if err == nil || err.Error() != expectedErr {
+		t.Errorf("Expected error %q, got %v.", expectedErr, err)
+	}
+}
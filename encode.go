@@ -0,0 +1,672 @@
+// Copyright 2013 The gopp AUTHORS. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gopp
+
+import (
+	"bytes"
+	"encoding"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// An Encoder writes objects as documents, the reverse of a Decoder. The
+// grammar's type= and field= tags are used to choose which of a rule's
+// definitions, which alternative, and how many repetitions to write, much as
+// the parser chooses them by looking at the document.
+type Encoder struct {
+	*DecoderFactory
+	io.Writer
+}
+
+func (df *DecoderFactory) NewEncoder(w io.Writer) (e Encoder) {
+	e = Encoder{
+		DecoderFactory: df,
+		Writer:         w,
+	}
+	return
+}
+
+// Encode writes obj as a document which decodes back into the same value.
+// Errors saying what could not be encoded are returned as *EncodeError.
+func (e *Encoder) Encode(obj interface{}) (err error) {
+	enc := &encoder{
+		g:      e.g,
+		types:  e.types,
+		active: map[activeKey]bool{},
+		keys:   map[uintptr][]reflect.Value{},
+	}
+	root := newEncTarget(reflect.ValueOf(obj), "", true)
+	st, err := enc.rules(e.start, root, encState{used: &useLog{counts: map[string]int{}}})
+	if err != nil {
+		return
+	}
+	if err = enc.complete(root, st); err != nil {
+		err = deeper(err, st.stopped)
+		return
+	}
+	document, err := enc.join(st.out)
+	if err != nil {
+		return
+	}
+	_, err = e.Writer.Write(document)
+	return
+}
+
+// An EncodeError says which part of an object could not be encoded.
+type EncodeError struct {
+	// Path is where in the object the error happened, like ".Rules[2].Expr".
+	Path string
+	Err  error
+}
+
+func (ee *EncodeError) Error() string {
+	return fmt.Sprintf("%s: %v", ee.Path, ee.Err)
+}
+
+// Unwrap returns the error that encoding ran into.
+func (ee *EncodeError) Unwrap() error {
+	return ee.Err
+}
+
+type encoder struct {
+	g     *CompiledGrammar
+	types map[string]reflect.Type
+	// active holds the rules being encoded, to stop left recursion.
+	active map[activeKey]bool
+	// keys holds the sorted keys of the maps being encoded.
+	keys map[uintptr][]reflect.Value
+}
+
+type activeKey struct {
+	name string
+	path string
+	at   int
+}
+
+type encToken struct {
+	typ string
+	raw string
+}
+
+// An encTarget is the part of the object that a node will be decoded into.
+type encTarget struct {
+	// v is invalid if the node will not be decoded into anything.
+	v    reflect.Value
+	path string
+	// owned is set if the node is all that will be decoded into v, so that
+	// once it's written all of v must have been.
+	owned bool
+	// key is set for a map entry, whose value is v.
+	key reflect.Value
+	// set is whether v was non-zero before looking through pointers, so that
+	// a pointer to a zero value is still written.
+	set bool
+}
+
+// newEncTarget looks through pointers and interfaces to what v holds, unless
+// they are TextMarshalers.
+func newEncTarget(v reflect.Value, path string, owned bool) (t encTarget) {
+	t = encTarget{path: path, owned: owned, set: v.IsValid() && !v.IsZero()}
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			return
+		}
+		if _, ok := textMarshaler(v); ok {
+			break
+		}
+		v = v.Elem()
+	}
+	t.v = v
+	return
+}
+
+// encState is how far encoding has gotten. Each alternative is tried from a
+// copy, so that a failed one leaves it alone. The copies share out and used,
+// which only works because a state is never used again once encoding has
+// gone back to one from before it.
+type encState struct {
+	out []encToken
+	// used counts how many times each part of the object, by path, has been
+	// written, which for slices and maps is how many of their elements. It
+	// is rolled back to this state's version whenever it is looked at.
+	used    *useLog
+	version int
+	// consumed counts the non-zero values written, to tell whether a
+	// repetition or optional part is needed.
+	consumed int
+	// pending is where the next node goes, after a {field=X} tag.
+	pending *encTarget
+	// stopped is why the last repetition stopped, which is a better error to
+	// report than that something was left unwritten.
+	stopped error
+}
+
+// A useLog holds the counts for encState.used, along with the paths they
+// were counted for, in order, so that they can be taken back.
+type useLog struct {
+	counts map[string]int
+	paths  []string
+}
+
+// at rolls the counts back to how they were at version.
+func (ul *useLog) at(version int) map[string]int {
+	for len(ul.paths) > version {
+		last := len(ul.paths) - 1
+		ul.counts[ul.paths[last]]--
+		ul.paths = ul.paths[:last]
+	}
+	return ul.counts
+}
+
+func (st encState) count(path string) int {
+	return st.used.at(st.version)[path]
+}
+
+func (st encState) use(path string, nonzero bool) encState {
+	st.used.at(st.version)[path]++
+	st.used.paths = append(st.used.paths, path)
+	st.version++
+	if nonzero {
+		st.consumed++
+	}
+	return st
+}
+
+func (st encState) emit(typ, raw string) encState {
+	// this may write over what a failed alternative left past the end.
+	st.out = append(st.out, encToken{typ, raw})
+	return st
+}
+
+func (e *encoder) fail(t encTarget, format string, args ...interface{}) error {
+	path := t.path
+	if path == "" {
+		path = "."
+	}
+	return &EncodeError{path, fmt.Errorf(format, args...)}
+}
+
+// deeper returns whichever error happened farther into the object, since
+// it's likely to be from the alternative that was meant to be used.
+func deeper(a, b error) error {
+	if a == nil {
+		return b
+	}
+	ea, okA := a.(*EncodeError)
+	eb, okB := b.(*EncodeError)
+	if okA && okB && len(eb.Path) > len(ea.Path) {
+		return b
+	}
+	return a
+}
+
+// rules writes cur using the first of the rules named name that fits it.
+func (e *encoder) rules(name string, cur encTarget, st encState) (next encState, err error) {
+	rules := e.g.RulesForName(name)
+	if len(rules) == 0 {
+		err = e.fail(cur, "Unknown rule name: %q.", name)
+		return
+	}
+	key := activeKey{name, cur.path, len(st.out)}
+	if e.active[key] {
+		err = e.fail(cur, "Rule %q is left-recursive.", name)
+		return
+	}
+	e.active[key] = true
+	defer delete(e.active, key)
+
+	for _, rule := range rules {
+		var rerr error
+		next, rerr = e.terms(rule.Expr, cur, st)
+		if rerr == nil {
+			err = nil
+			return
+		}
+		err = deeper(err, rerr)
+	}
+	return
+}
+
+func (e *encoder) terms(terms []Term, cur encTarget, st encState) (next encState, err error) {
+	next = st
+	for _, term := range terms {
+		if next, err = e.term(term, cur, next); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (e *encoder) term(term Term, cur encTarget, st encState) (next encState, err error) {
+	switch t := term.(type) {
+	case TagTerm:
+		return e.tag(Tag(t.Tag), cur, st)
+	case LiteralTerm:
+		var target encTarget
+		if target, st, err = e.next(cur, st); err != nil {
+			return
+		}
+		if target.v.IsValid() {
+			text, ok := leafText(target.v)
+			if !ok || text != t.Literal {
+				err = e.fail(target, "Value is not %s.", quoteLiteral(t.Literal))
+				return
+			}
+			st = st.use(target.path, !target.v.IsZero())
+		}
+		next = st.emit("RAW", t.Literal)
+	case InlineRuleTerm:
+		if len(e.g.RulesForName(t.Name)) != 0 {
+			next, err = e.rules(t.Name, cur, st)
+			if err == nil {
+				return
+			}
+		}
+		if _, ok := e.g.Symbol(t.Name); ok {
+			return e.symbol(t.Name, cur, st)
+		}
+		if err == nil {
+			err = e.fail(cur, "Unknown rule name: %q.", t.Name)
+		}
+	case RuleTerm:
+		return e.subtree(cur, st, func(target encTarget, st encState) (encState, error) {
+			return e.rules(t.Name, target, st)
+		})
+	case RepeatZeroTerm:
+		return e.subtree(cur, st, func(target encTarget, st encState) (encState, error) {
+			return e.repeat(t.Term, 0, target, st)
+		})
+	case RepeatOneTerm:
+		return e.subtree(cur, st, func(target encTarget, st encState) (encState, error) {
+			return e.repeat(t.Term, 1, target, st)
+		})
+	case OptionalTerm:
+		// leave it out, unless it writes something that would be missed.
+		next, err = e.terms(t.Expr, cur, st)
+		if err != nil || next.consumed == st.consumed {
+			next, err = st, nil
+		}
+	case GroupTerm:
+		return e.terms(t.Expr, cur, st)
+	case AlternationTerm:
+		for _, expr := range t.Exprs {
+			var aerr error
+			next, aerr = e.terms(expr, cur, st)
+			if aerr == nil {
+				err = nil
+				return
+			}
+			err = deeper(err, aerr)
+		}
+		if err == nil {
+			err = e.fail(cur, "Alternation with no choices.")
+		}
+	default:
+		err = e.fail(cur, "Unknown term %T.", term)
+	}
+	return
+}
+
+// tag handles {field=X}, which says where the next node goes, and
+// {type=T}, which must match what is being written.
+func (e *encoder) tag(tag Tag, cur encTarget, st encState) (next encState, err error) {
+	next = st
+	if !cur.v.IsValid() {
+		if _, isType := getTagValue("type", tag); isType {
+			err = e.fail(cur, "Nothing to write as %s.", tag)
+		}
+		return
+	}
+	if cur.key.IsValid() {
+		// a map entry, where only {key} and {value} mean anything.
+		switch tag {
+		case "key":
+			target := newEncTarget(cur.key, cur.path+"{key}", true)
+			next.pending = &target
+		case "value":
+			target := newEncTarget(cur.v, cur.path, true)
+			next.pending = &target
+		}
+		return
+	}
+	if typName, isType := getTagValue("type", tag); isType {
+		if !typeNamed(e.types, typName, cur.v.Type()) {
+			err = e.fail(cur, "Type %s is not %s.", cur.v.Type(), typName)
+		}
+		return
+	}
+	name, isField := getTagValue("field", tag)
+	if !isField || !isEncStruct(cur.v) {
+		return
+	}
+	target := cur
+	target.owned = false
+	if name != "." {
+		var fv reflect.Value
+		var fieldPath string
+		if fv, fieldPath, err = getField(cur.v, name, false); err != nil {
+			err = e.fail(cur, "%v", err)
+			return
+		}
+		kind := fv.Kind()
+		target = newEncTarget(fv, cur.path+fieldPath, kind != reflect.Slice && kind != reflect.Map)
+	}
+	next.pending = &target
+	return
+}
+
+// next finds the target for the next node in cur's list.
+func (e *encoder) next(cur encTarget, st encState) (target encTarget, next encState, err error) {
+	next = st
+	switch {
+	case !cur.v.IsValid():
+	case cur.key.IsValid() || isEncStruct(cur.v):
+		if st.pending != nil {
+			target = *st.pending
+			next.pending = nil
+			// slices and maps count their elements instead.
+			if kind := target.v.Kind(); kind != reflect.Slice && kind != reflect.Map {
+				next = next.use(target.path, target.set)
+			}
+		}
+	case cur.v.Kind() == reflect.Slice || cur.v.Kind() == reflect.Array:
+		i := st.count(cur.path)
+		if i >= cur.v.Len() {
+			err = e.fail(cur, "No more elements.")
+			return
+		}
+		target = newEncTarget(cur.v.Index(i), fmt.Sprintf("%s[%d]", cur.path, i), true)
+		next = next.use(cur.path, true)
+	case cur.v.Kind() == reflect.Map:
+		keys, ok := e.keys[cur.v.Pointer()]
+		if !ok {
+			keys = sortedKeys(cur.v)
+			e.keys[cur.v.Pointer()] = keys
+		}
+		i := st.count(cur.path)
+		if i >= len(keys) {
+			err = e.fail(cur, "No more entries.")
+			return
+		}
+		target = newEncTarget(cur.v.MapIndex(keys[i]), fmt.Sprintf("%s[%#v]", cur.path, keys[i].Interface()), true)
+		target.key = keys[i]
+		next = next.use(cur.path, true)
+	default:
+		err = e.fail(cur, "Cannot write %s as a list.", cur.v.Type())
+	}
+	return
+}
+
+// subtree writes a node with its own list of children, like a rule or a
+// repetition.
+func (e *encoder) subtree(cur encTarget, st encState, children func(encTarget, encState) (encState, error)) (next encState, err error) {
+	target, next, err := e.next(cur, st)
+	if err != nil {
+		return
+	}
+	pending := next.pending
+	next.pending = nil
+	if next, err = children(target, next); err != nil {
+		return
+	}
+	if target.owned {
+		if err = e.complete(target, next); err != nil {
+			err = deeper(err, next.stopped)
+			return
+		}
+		next.stopped = nil
+	}
+	next.pending = pending
+	return
+}
+
+// repeat writes term as many times as it keeps finding things to write, and
+// at least min times.
+func (e *encoder) repeat(term Term, min int, cur encTarget, st encState) (next encState, err error) {
+	next = st
+	for n := 0; ; n++ {
+		var more encState
+		more, err = e.term(term, cur, next)
+		if err != nil {
+			if n >= min {
+				next.stopped = deeper(next.stopped, err)
+				err = nil
+			}
+			return
+		}
+		if more.consumed == next.consumed && n >= min {
+			// nothing was written, so another time would be the same.
+			return
+		}
+		next = more
+	}
+}
+
+func (e *encoder) symbol(name string, cur encTarget, st encState) (next encState, err error) {
+	target, next, err := e.next(cur, st)
+	if err != nil {
+		return
+	}
+	if !target.v.IsValid() {
+		err = e.fail(cur, "Nothing to write as <%s>.", name)
+		return
+	}
+	text, ok := leafText(target.v)
+	if !ok {
+		err = e.fail(target, "Cannot write %s as <%s>.", target.v.Type(), name)
+		return
+	}
+	raw, ok := e.symbolRaw(name, text)
+	if !ok {
+		err = e.fail(target, "%q is not a <%s>.", text, name)
+		return
+	}
+	next = next.use(target.path, !target.v.IsZero()).emit(name, raw)
+	return
+}
+
+// symbolRaw finds the text in a document that gives a symbol the text s. This
+// is s itself, escaped if it has anything unprintable or would otherwise be
+// unescaped when decoded, with whatever the symbol's regexp needs around its
+// captured group.
+func (e *encoder) symbolRaw(name string, s string) (raw string, ok bool) {
+	ds, err := descapeString(s)
+	unprintable := strings.IndexFunc(s, func(r rune) bool { return !strconv.IsPrint(r) }) != -1
+	if unprintable || err == nil && ds != s {
+		s = escapeString(s)
+	}
+	for _, re := range e.g.TokenizeInfo.TokenREs {
+		if re.Type != name {
+			continue
+		}
+		prefix, suffix := captureContext(re.String())
+		raw = prefix + s + suffix
+		m := re.FindStringSubmatch(raw)
+		ok = m != nil && m[0] == raw && (len(m) < 2 || m[1] == s)
+		return
+	}
+	return
+}
+
+// captureContext finds the literal text before and after the captured group
+// in a pattern like /'(.*)'/.
+func captureContext(pattern string) (prefix, suffix string) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil || re.Op != syntax.OpConcat {
+		return
+	}
+	var before, after []string
+	captured := false
+	for _, sub := range re.Sub {
+		switch sub.Op {
+		case syntax.OpBeginText, syntax.OpBeginLine, syntax.OpEndText, syntax.OpEndLine:
+		case syntax.OpLiteral:
+			if captured {
+				after = append(after, string(sub.Rune))
+			} else {
+				before = append(before, string(sub.Rune))
+			}
+		case syntax.OpCapture:
+			if captured {
+				return
+			}
+			captured = true
+		default:
+			return
+		}
+	}
+	prefix, suffix = strings.Join(before, ""), strings.Join(after, "")
+	return
+}
+
+// complete checks that everything in t that decoding would fill in has been
+// written.
+func (e *encoder) complete(t encTarget, st encState) (err error) {
+	switch {
+	case !t.v.IsValid():
+	case t.key.IsValid():
+		if st.count(t.path+"{key}") == 0 {
+			err = e.fail(t, "Map entry has no {key}.")
+		} else if !t.v.IsZero() && st.count(t.path) == 0 {
+			err = e.fail(t, "Map entry has no {value}.")
+		}
+	case isEncStruct(t.v):
+	fieldLoop:
+		for _, f := range goppFields(t.v.Type()) {
+			fv := fieldByIndex(t.v, f.index, false)
+			if f.embedded || !fv.IsValid() || fv.Type() == posType || fv.Type() == spanType {
+				continue
+			}
+			// a promoted field is written if the struct it is in was.
+			for i := 1; i < len(f.path); i++ {
+				if f.path[i] == '.' && st.count(t.path+f.path[:i]) != 0 {
+					continue fieldLoop
+				}
+			}
+			path := t.path + f.path
+			name := f.path[1:]
+			switch fv.Kind() {
+			case reflect.Slice, reflect.Map:
+				if used := st.count(path); used != fv.Len() {
+					err = e.fail(t, "Only %d of the %d elements of %s were written.", used, fv.Len(), name)
+					return
+				}
+			default:
+				if !fv.IsZero() && st.count(path) == 0 {
+					err = e.fail(t, "Field %s was not written.", name)
+					return
+				}
+			}
+		}
+	case t.v.Kind() == reflect.Slice || t.v.Kind() == reflect.Array || t.v.Kind() == reflect.Map:
+		if used := st.count(t.path); used != t.v.Len() {
+			err = e.fail(t, "Only %d of the %d elements were written.", used, t.v.Len())
+		}
+	}
+	return
+}
+
+// join puts the tokens together into a document, with spaces between them if
+// the grammar ignores spaces, and makes sure it tokenizes as they were meant.
+func (e *encoder) join(tokens []encToken) (document []byte, err error) {
+	spaced := false
+	for _, re := range e.g.TokenizeInfo.IgnoreREs {
+		if re.FindString(" ") == " " {
+			spaced = true
+		}
+	}
+	var buf bytes.Buffer
+	for i, tok := range tokens {
+		if i != 0 && spaced && !strings.HasSuffix(tokens[i-1].raw, "\n") && !strings.HasPrefix(tok.raw, "\n") {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(tok.raw)
+	}
+	document = buf.Bytes()
+
+	read, err := Tokenize(e.g.TokenizeInfo, document)
+	if err != nil {
+		return
+	}
+	for i, tok := range tokens {
+		if i == len(read) || read[i].Raw != tok.raw || read[i].Type != tok.typ {
+			err = fmt.Errorf("Written %s %q would not be read back as one.", tok.typ, tok.raw)
+			return
+		}
+	}
+	if len(read) != len(tokens) {
+		err = fmt.Errorf("Written document has %d tokens, not %d.", len(read), len(tokens))
+	}
+	return
+}
+
+func isEncStruct(v reflect.Value) bool {
+	_, marshals := textMarshaler(v)
+	return v.Kind() == reflect.Struct && !marshals
+}
+
+func textMarshaler(v reflect.Value) (m encoding.TextMarshaler, ok bool) {
+	if v.CanInterface() {
+		if m, ok = v.Interface().(encoding.TextMarshaler); ok {
+			return
+		}
+	}
+	if v.CanAddr() && v.Addr().CanInterface() {
+		m, ok = v.Addr().Interface().(encoding.TextMarshaler)
+	}
+	return
+}
+
+// leafText is the text that decodes into v, the reverse of what decode does
+// with symbols and literals.
+func leafText(v reflect.Value) (text string, ok bool) {
+	if m, isMarshaler := textMarshaler(v); isMarshaler {
+		b, err := m.MarshalText()
+		return string(b), err == nil
+	}
+	ok = true
+	switch v.Kind() {
+	case reflect.String:
+		text = v.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		text = strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		text = strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		text = strconv.FormatFloat(v.Float(), 'g', -1, v.Type().Bits())
+	case reflect.Complex64, reflect.Complex128:
+		text = strconv.FormatComplex(v.Complex(), 'g', -1, v.Type().Bits())
+	case reflect.Bool:
+		text = strconv.FormatBool(v.Bool())
+	default:
+		ok = false
+	}
+	return
+}
+
+// sortedKeys orders a map's keys by how they print, so that encoding is
+// repeatable.
+func sortedKeys(m reflect.Value) (keys []reflect.Value) {
+	type printedKey struct {
+		key     reflect.Value
+		printed string
+	}
+	var pks []printedKey
+	for _, key := range m.MapKeys() {
+		pks = append(pks, printedKey{key, fmt.Sprint(key.Interface())})
+	}
+	sort.Slice(pks, func(i, j int) bool {
+		return pks[i].printed < pks[j].printed
+	})
+	for _, pk := range pks {
+		keys = append(keys, pk.key)
+	}
+	return
+}
@@ -0,0 +1,188 @@
+// Copyright 2013 The gopp AUTHORS. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gopp_test
+
+import (
+	"bytes"
+	"errors"
+	"github.com/skelterjohn/gopp"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeMath(t *testing.T) {
+	df, err := gopp.NewDecoderFactory(mathgopp, "Eqn")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	df.RegisterType(MathExprFactor{})
+	df.RegisterType(MathNumberFactor{})
+	df.RegisterType(MathSum{})
+	df.RegisterType(MathProduct{})
+
+	eqn := MathEqn{
+		Left: MathProduct{
+			First:  MathExprFactor{MathSum{MathNumberFactor{1}, MathNumberFactor{2}}},
+			Second: MathNumberFactor{3},
+		},
+		Right: MathNumberFactor{9},
+	}
+	var buf bytes.Buffer
+	enc := df.NewEncoder(&buf)
+	if err = enc.Encode(eqn); err != nil {
+		t.Error(err)
+		return
+	}
+	expected := "(1+2)*3=9\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q, got %q.", expected, buf.String())
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	grammar := `
+ignore: /^\s+/
+Start => {field=Name} <word> {field=Shapes} <<Shape>>* ['{' {field=Vars} <<Var>>* '}']
+Shape => {type=Circle} 'circle' {field=Radius} <dig>
+Shape => {type=Square} 'square' {field=Side} <dig>
+Var => {key} <word> '=' {value} <dig>
+
+word = /([a-z]+)/
+dig = /(\d+)/
+`
+	df, err := gopp.NewDecoderFactory(grammar, "Start")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	df.RegisterType(Circle{})
+	df.RegisterType(Square{})
+
+	type Picture struct {
+		Name   string
+		Shapes []Shape
+		Vars   map[string]int
+	}
+	cases := []struct {
+		pic      Picture
+		document string
+	}{
+		{
+			Picture{Name: "pic", Shapes: []Shape{Circle{1}, Square{2}}},
+			"pic circle 1 square 2",
+		},
+		{
+			Picture{Name: "pic", Shapes: []Shape{Circle{0}}, Vars: map[string]int{"b": 2, "a": 1}},
+			"pic circle 0 { a = 1 b = 2 }",
+		},
+	}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		enc := df.NewEncoder(&buf)
+		if err = enc.Encode(&c.pic); err != nil {
+			t.Error(err)
+			continue
+		}
+		if buf.String() != c.document {
+			t.Errorf("Expected %q, got %q.", c.document, buf.String())
+		}
+		var pic Picture
+		dec := df.NewDecoder(&buf)
+		dec.Strict()
+		if err = dec.Decode(&pic); err != nil {
+			t.Error(err)
+			continue
+		}
+		if !reflect.DeepEqual(pic, c.pic) {
+			t.Errorf("Expected %v, got %v.", c.pic, pic)
+		}
+	}
+
+	errs := []struct {
+		pic Picture
+		err string
+	}{
+		{Picture{Name: "pic", Shapes: []Shape{Square{2}, Drawing{}}}, ".Shapes[1]: Type gopp_test.Drawing is not Circle."},
+		{Picture{Name: "Pic"}, `.Name: "Pic" is not a <word>.`},
+	}
+	for _, e := range errs {
+		var buf bytes.Buffer
+		enc := df.NewEncoder(&buf)
+		err = enc.Encode(&e.pic)
+		if _, ok := err.(*gopp.EncodeError); !ok || err.Error() != e.err {
+			t.Errorf("Expected error %q, got %v.", e.err, err)
+		} else if errors.Unwrap(err) == nil {
+			t.Errorf("Expected %v to wrap the error that was found.", err)
+		}
+	}
+}
+
+func TestEncodeEmbedded(t *testing.T) {
+	df, err := gopp.NewDecoderFactory(methodgopp, "Start")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var buf bytes.Buffer
+	enc := df.NewEncoder(&buf)
+	if err = enc.Encode(Method{Named{"main"}, &Returns{"int"}, "t"}); err != nil {
+		t.Error(err)
+		return
+	}
+	expected := "t main int"
+	if buf.String() != expected {
+		t.Errorf("Expected %q, got %q.", expected, buf.String())
+	}
+
+	buf.Reset()
+	err = enc.Encode(Method{Named: Named{"main"}, Recv: "t"})
+	if err == nil || err.Error() != `.: Field "return_type" of type Method is inside a nil embedded struct.` {
+		t.Errorf("Expected the return type to be missing, got %v.", err)
+	}
+}
+
+type Thing struct {
+	N int
+}
+
+type Opts struct {
+	Name  string
+	Opt   *Thing
+	Count *int
+}
+
+func TestEncodeZeroPointers(t *testing.T) {
+	df, err := gopp.NewDecoderFactory(`
+ignore: /^\s+/
+Start => {field=Name} <word> [{field=Opt} <<Thing>>] ['count' {field=Count} <dig>]
+Thing => 'thing' [{field=N} <dig>]
+
+word = /([a-z]+)/
+dig = /(\d+)/
+`, "Start")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// pointers to zero values are still there to be written.
+	for _, document := range []string{"abc", "abc thing", "abc thing 2", "abc count 0", "abc thing count 0"} {
+		var opts Opts
+		dec := df.NewDecoder(bytes.NewBufferString(document))
+		if err = dec.Decode(&opts); err != nil {
+			t.Error(err)
+			continue
+		}
+		var buf bytes.Buffer
+		enc := df.NewEncoder(&buf)
+		if err = enc.Encode(&opts); err != nil {
+			t.Errorf("With %q, %v", document, err)
+			continue
+		}
+		if buf.String() != document {
+			t.Errorf("Expected %q, got %q.", document, buf.String())
+		}
+	}
+}
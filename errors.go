@@ -0,0 +1,331 @@
+// Copyright 2013 The gopp AUTHORS. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gopp
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A ParseError describes where a document stopped matching its grammar. It
+// is reported at the farthest point the parser reached, since that is almost
+// always where the actual mistake is.
+type ParseError struct {
+	Row, Col int
+	// Offset is the byte offset into the document.
+	Offset int
+	// Token is the token that could not be parsed, or nil if the document
+	// ended too soon.
+	Token *Token
+	// Expected holds everything that would have been accepted instead, in
+	// gopp notation: 'literal' for literals and <name> for symbols. It is
+	// empty if the parser expected the document to end.
+	Expected []string
+	// Rules is the stack of rules being parsed when the parser got stuck,
+	// outermost first. If the expectations came from different places, only
+	// the rules they have in common are included.
+	Rules []string
+}
+
+func (pe *ParseError) Error() string {
+	var expected string
+	switch len(pe.Expected) {
+	case 0:
+		expected = "expected EOF"
+	case 1:
+		expected = "expected " + pe.Expected[0]
+	default:
+		expected = "expected one of " + strings.Join(pe.Expected, " ")
+	}
+	return fmt.Sprintf("%s but found %s at %d:%d", expected, pe.found(), pe.Row, pe.Col)
+}
+
+func (pe *ParseError) found() string {
+	if pe.Token == nil {
+		return "EOF"
+	}
+	if pe.Token.Type == "RAW" {
+		return quoteLiteral(pe.Token.Text)
+	}
+	return fmt.Sprintf("<%s> %s", pe.Token.Type, quoteLiteral(pe.Token.Text))
+}
+
+func quoteLiteral(literal string) string {
+	return "'" + escapeString(literal) + "'"
+}
+
+// expect notes that what would have been accepted with the given tokens
+// remaining. Only the expectations for the fewest remaining tokens are kept.
+func (pd *ParseData) expect(what string, remaining []Token) {
+	if pd.expected == nil || len(remaining) < pd.expectedAt {
+		pd.expected = map[string]bool{}
+		pd.expectedAt = len(remaining)
+		pd.expectedRules = append([]string{}, pd.ruleStack...)
+	}
+	if len(remaining) < pd.reached {
+		pd.reached = len(remaining)
+	}
+	if len(remaining) == pd.expectedAt {
+		pd.expected[what] = true
+		for i := range pd.expectedRules {
+			if i == len(pd.ruleStack) || pd.ruleStack[i] != pd.expectedRules[i] {
+				pd.expectedRules = pd.expectedRules[:i]
+				break
+			}
+		}
+	}
+}
+
+// parseError builds a ParseError for the farthest failure, given all the
+// tokens in the document and the tokens that could not be parsed. If the
+// parse succeeded with those tokens left over, the end of the document was
+// also expected there.
+func (pd *ParseData) parseError(tokens, remaining []Token, leftover bool) (pe *ParseError) {
+	at := len(remaining)
+	if pd.expected != nil && pd.expectedAt <= at {
+		at = pd.expectedAt
+	}
+	pe = pd.errorAt(tokens, at)
+	if leftover && at == len(remaining) && len(pe.Expected) != 0 {
+		pe.Expected = append(pe.Expected, "EOF")
+	}
+	return
+}
+
+// ParseErrors holds every error found in a document, in order, when the
+// parser was able to recover from some of them.
+type ParseErrors []*ParseError
+
+func (pes ParseErrors) Error() string {
+	var msgs []string
+	for _, pe := range pes {
+		msgs = append(msgs, pe.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// An ErrorNode is put into the AST in place of the tokens that were skipped
+// when recovering from an error.
+type ErrorNode struct {
+	*ParseError
+	Skipped []Token
+}
+
+func (en ErrorNode) String() string {
+	return fmt.Sprintf("Error(%v)", en.ParseError)
+}
+
+// syncLiteral finds the literal given by a {sync=X} tag at the top level of
+// one of the rules. A rule with such a tag that fails, after getting past its
+// first token, skips to just after the next X and succeeds with an ErrorNode.
+func syncLiteral(rules []Rule) (literal string, ok bool) {
+	for _, rule := range rules {
+		for _, term := range rule.Expr {
+			if tt, isTag := term.(TagTerm); isTag {
+				if literal, ok = getTagValue("sync", Tag(tt.Tag)); ok {
+					return
+				}
+			}
+		}
+	}
+	return
+}
+
+// recover skips from the farthest point reached to just past the next sync
+// literal, leaving an ErrorNode for the error found there.
+func (pd *ParseData) recover(sync string, tokens []Token) (items []Node, remainingTokens []Token, ok bool) {
+	for i := len(tokens) - pd.reached; i < len(tokens); i++ {
+		if tokens[i].Type != "RAW" || tokens[i].Text != sync {
+			continue
+		}
+		pe := pd.errorAt(tokens, pd.reached)
+		items = []Node{ErrorNode{pe, tokens[:i+1]}}
+		remainingTokens = tokens[i+1:]
+		ok = true
+		return
+	}
+	return
+}
+
+// errorAt builds a ParseError for the point with at tokens remaining.
+func (pd *ParseData) errorAt(tokens []Token, at int) (pe *ParseError) {
+	pe = &ParseError{}
+	if pd.expected != nil && pd.expectedAt == at {
+		for what := range pd.expected {
+			pe.Expected = append(pe.Expected, what)
+		}
+		sort.Strings(pe.Expected)
+		pe.Rules = pd.expectedRules
+	}
+	if at == 0 {
+		pe.Offset = pd.documentEnd
+		pe.Row, pe.Col = endPosition(tokens)
+		return
+	}
+	token := tokens[len(tokens)-at]
+	pe.Token = &token
+	pe.Row, pe.Col = token.Row, token.Col
+	pe.Offset = token.Offset
+	return
+}
+
+// recoveredErrors returns the errors recovered from in items, which are those
+// of the ErrorNodes in it, followed by last, if it isn't nil. Errors recovered
+// from in alternatives that were backtracked out of aren't in items, and so
+// aren't reported. Without any recovered errors, last is returned alone.
+func recoveredErrors(items []Node, last *ParseError) error {
+	var pes ParseErrors
+	var walk func(nodes []Node)
+	walk = func(nodes []Node) {
+		for _, node := range nodes {
+			switch node := node.(type) {
+			case ErrorNode:
+				if last == nil || node.Offset < last.Offset {
+					pes = append(pes, node.ParseError)
+				}
+			case []Node:
+				walk(node)
+			case AST:
+				walk([]Node(node))
+			}
+		}
+	}
+	walk(items)
+	if len(pes) == 0 {
+		if last == nil {
+			return nil
+		}
+		return last
+	}
+	sort.Sort(parseErrorSorter(pes))
+	if last != nil {
+		pes = append(pes, last)
+	}
+	return pes
+}
+
+type parseErrorSorter ParseErrors
+
+func (p parseErrorSorter) Len() int {
+	return len(p)
+}
+
+func (p parseErrorSorter) Swap(i, j int) {
+	p[i], p[j] = p[j], p[i]
+}
+
+func (p parseErrorSorter) Less(i, j int) bool {
+	return p[i].Offset < p[j].Offset
+}
+
+// A DecodeError says where decoding an AST into an object went wrong.
+type DecodeError struct {
+	// Path is where in the object the error happened, like ".Rules[2].Expr".
+	Path string
+	// ASTPath holds the index of each node on the way from the root of the
+	// AST down to the one that could not be decoded.
+	ASTPath []int
+	// Pos is where in the document that node came from, or nil if that isn't
+	// known.
+	Pos *Pos
+	Err error
+}
+
+func (de *DecodeError) Error() string {
+	if de.Pos == nil {
+		return fmt.Sprintf("%s: %v", de.Path, de.Err)
+	}
+	return fmt.Sprintf("%s at %v: %v", de.Path, *de.Pos, de.Err)
+}
+
+// Unwrap returns the error that decoding ran into, such as one returned by an
+// Unmarshaler.
+func (de *DecodeError) Unwrap() error {
+	return de.Err
+}
+
+// endPosition finds the row and column just after the last token.
+func endPosition(tokens []Token) (row, col int) {
+	if len(tokens) == 0 {
+		return
+	}
+	end := tokenEnd(tokens[len(tokens)-1])
+	row, col = end.Row, end.Col
+	return
+}
+
+// errorContextLines is how many lines are shown before and after the
+// offending line by RenderError.
+const errorContextLines = 2
+
+// RenderError describes err in the style of a compiler diagnostic, showing
+// the lines of document around where err occurred with a caret pointing at
+// the offending spot. ParseErrors are rendered one after another. If err is
+// not one of these, a *TokenizeError, or a *DecodeError with a position, only
+// its message is returned, and if err is nil, nothing is.
+func RenderError(document []byte, err error) string {
+	if err == nil {
+		return ""
+	}
+	var offset int
+	switch err := err.(type) {
+	case ParseErrors:
+		var rendered []string
+		for _, pe := range err {
+			rendered = append(rendered, RenderError(document, pe))
+		}
+		return strings.Join(rendered, "\n")
+	case *ParseError:
+		offset = err.Offset
+	case *TokenizeError:
+		offset = err.Offset
+	case *DecodeError:
+		if err.Pos == nil {
+			return err.Error()
+		}
+		offset = err.Pos.Offset
+	default:
+		return err.Error()
+	}
+	if offset > len(document) {
+		offset = len(document)
+	}
+
+	lines := strings.Split(string(document), "\n")
+	row := strings.Count(string(document[:offset]), "\n")
+	lineStart := strings.LastIndex(string(document[:offset]), "\n") + 1
+
+	first, last := row-errorContextLines, row+errorContextLines
+	if first < 0 {
+		first = 0
+	}
+	if last >= len(lines) {
+		last = len(lines) - 1
+	}
+	width := len(fmt.Sprint(last + 1))
+
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, err)
+	for i := first; i <= last; i++ {
+		line := fmt.Sprintf("%*d | %s", width, i+1, strings.TrimRight(lines[i], "\r"))
+		fmt.Fprintln(&buf, strings.TrimRight(line, " "))
+		if i != row {
+			continue
+		}
+		// keep tabs, so the caret lines up however they are displayed.
+		var caret bytes.Buffer
+		for _, c := range string(document[lineStart:offset]) {
+			if c == '\t' {
+				caret.WriteRune('\t')
+			} else {
+				caret.WriteRune(' ')
+			}
+		}
+		fmt.Fprintf(&buf, "%*s | %s^\n", width, "", caret.String())
+	}
+	return buf.String()
+}
@@ -6,6 +6,7 @@ package gopp_test
 
 import (
 	"github.com/skelterjohn/gopp"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -30,8 +31,24 @@ Start => 'x' 'y' 'z'
 `,
 		Cases: []ErrorCase{
 			ErrorCase{`xyz`, ``},
-			ErrorCase{`xzy`, `Expected "y" at 0:1.`},
-			ErrorCase{`x`, `Expected "y" at EOF.`},
+			ErrorCase{`xzy`, `expected 'y' but found 'z' at 0:1`},
+			ErrorCase{`x`, `expected 'y' but found EOF at 0:1`},
+			ErrorCase{`xyzz`, `expected EOF but found 'z' at 0:3`},
+		},
+	},
+	ErrorSubject{
+		Name: "ExpectedSet",
+		Gopp: `
+Start => 'x' ('y' | 'z' | <number>) [',' <number>]
+number = /(\d+)/
+`,
+		Cases: []ErrorCase{
+			ErrorCase{`x1,2`, ``},
+			ErrorCase{`xx`, `expected one of 'y' 'z' <number> but found 'x' at 0:1`},
+			ErrorCase{`x1,2x3`, ``},
+			ErrorCase{`x`, `expected one of 'y' 'z' <number> but found EOF at 0:1`},
+			ErrorCase{`x1y`, `expected one of ',' EOF but found 'y' at 0:2`},
+			ErrorCase{`x1,`, `expected <number> but found EOF at 0:3`},
 		},
 	},
 }
@@ -47,11 +64,197 @@ subject:
 	scase:
 		for _, c := range s.Cases {
 			dec := df.NewDecoder(strings.NewReader(c.Document))
-			err = dec.Decode(&XYZ{})
-			if !(err == nil && c.ExpectedError == "") && (err != nil && err.Error() != c.ExpectedError) {
-				t.Error(err)
+			errs := decodeAll(&dec)
+			err = nil
+			if len(errs) != 0 {
+				err = errs[0]
+			}
+			if err == nil && c.ExpectedError != "" {
+				t.Errorf("(%s) With %q, expected error %q.", s.Name, c.Document, c.ExpectedError)
+				continue scase
+			}
+			if err != nil && err.Error() != c.ExpectedError {
+				t.Errorf("(%s) With %q, got error %q, expected %q.", s.Name, c.Document, err, c.ExpectedError)
 				continue scase
 			}
 		}
 	}
 }
+
+// decodeAll decodes documents from dec until there are no more, or it finds
+// an error that it cannot get past. Errors that were recovered from are
+// listed individually.
+func decodeAll(dec *gopp.Decoder) (errs []error) {
+	for dec.More() {
+		err := dec.Decode(&XYZ{})
+		if pes, ok := err.(gopp.ParseErrors); ok {
+			for _, pe := range pes {
+				errs = append(errs, pe)
+			}
+		} else if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return
+}
+
+func TestParseError(t *testing.T) {
+	df, err := gopp.NewDecoderFactory(`
+ignore: /^\s+/
+Start => <<List>>
+List => '(' <<Item>>* ')'
+Item => <number>
+Item => <<List>>
+number = /(\d+)/
+`, "Start")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	dec := df.NewDecoder(strings.NewReader("(1 (2\n 3 ("))
+	err = dec.Decode(&XYZ{})
+	pe, ok := err.(*gopp.ParseError)
+	if !ok {
+		t.Errorf("Expected a *gopp.ParseError, got %T: %v.", err, err)
+		return
+	}
+	if pe.Offset != 10 {
+		t.Errorf("Expected offset %d, got %d.", 10, pe.Offset)
+	}
+	if pe.Token != nil {
+		t.Errorf("Expected EOF, got %v.", pe.Token)
+	}
+	expected := []string{"'('", "')'", "<number>"}
+	if !reflect.DeepEqual(pe.Expected, expected) {
+		t.Errorf("Expected %v, got %v.", expected, pe.Expected)
+	}
+	rules := []string{"Start", "List", "Item", "List", "Item", "List"}
+	if !reflect.DeepEqual(pe.Rules, rules) {
+		t.Errorf("Expected rules %v, got %v.", rules, pe.Rules)
+	}
+}
+
+func TestRenderError(t *testing.T) {
+	df, err := gopp.NewDecoderFactory(`
+ignore: /^[ \t]+/
+Start => '\n'* <<Line>>*
+Line => {field=X} <word> '=' {field=Y} <word> '\n'+
+word = /([a-z]+)/
+`, "Start")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	document := "a = b\nc = d\n\te f\ng = h\ni = j\nk = l\n"
+	dec := df.NewDecoder(strings.NewReader(document))
+	errs := decodeAll(&dec)
+	if len(errs) != 1 {
+		t.Errorf("Expected one error, got %v.", errs)
+		return
+	}
+	err = errs[0]
+	expected := err.Error() + `
+1 | a = b
+2 | c = d
+3 | 	e f
+  | 	  ^
+4 | g = h
+5 | i = j
+`
+	if rendered := gopp.RenderError([]byte(document), err); rendered != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, rendered)
+	}
+
+	document = "a = b\nc ? d\n"
+	dec = df.NewDecoder(strings.NewReader(document))
+	err = dec.Decode(&XYZ{})
+	if _, ok := err.(*gopp.TokenizeError); !ok {
+		t.Errorf("Expected a *gopp.TokenizeError, got %T: %v.", err, err)
+		return
+	}
+	expected = err.Error() + `
+1 | a = b
+2 | c ? d
+  |   ^
+3 |
+`
+	if rendered := gopp.RenderError([]byte(document), err); rendered != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, rendered)
+	}
+
+	if rendered := gopp.RenderError([]byte(document), nil); rendered != "" {
+		t.Errorf("Expected nothing for a nil error, got\n%s", rendered)
+	}
+}
+
+const recoverygopp = `
+ignore: /^[ \t]+/
+Start => <<Line>>*
+Line => {sync=\n} {field=X} <word> '=' {field=Y} <word> '\n'
+word = /([a-z]+)/
+`
+
+func TestRecovery(t *testing.T) {
+	df, err := gopp.NewDecoderFactory(recoverygopp, "Start")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cases := []struct {
+		document string
+		expected []string
+	}{
+		{"a=b\nc=d\n", nil},
+		{"a=b\nc\ne=f\ng==h\ni=j\n", []string{
+			`expected '=' but found '\n' at 1:1`,
+			`expected <word> but found '=' at 3:2`,
+		}},
+		{"a=b\nc\n=x\n", []string{
+			`expected '=' but found '\n' at 1:1`,
+			`expected one of <word> EOF but found '=' at 2:0`,
+		}},
+	}
+	for _, c := range cases {
+		dec := df.NewDecoder(strings.NewReader(c.document))
+		var msgs []string
+		for _, err := range decodeAll(&dec) {
+			if _, ok := err.(*gopp.ParseError); !ok {
+				t.Errorf("With %q, expected a *gopp.ParseError, got %T: %v.", c.document, err, err)
+			}
+			msgs = append(msgs, err.Error())
+		}
+		if !reflect.DeepEqual(msgs, c.expected) {
+			t.Errorf("With %q, expected errors %q, got %q.", c.document, c.expected, msgs)
+		}
+	}
+
+	// a rule that recovers in an alternative that is later backtracked out
+	// of leaves no error behind.
+	g, err := gopp.NewGrammar(`
+ignore: /^\s+/
+Start => <<Stmts>> | <<Other>>
+Stmts => <<Stmt>>+ 'end'
+Stmt => {sync=;} 'a' 'b' ';'
+Other => 'a' 'c' ';' 'x'
+`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	pd := gopp.NewParseData()
+	ast, err := gopp.ParseWithData(g, "Start", []byte("a c ; x"), pd)
+	if err != nil || ast == nil {
+		t.Errorf("Expected the other alternative to parse, got %v with %v.", ast, err)
+	}
+
+	// and the same ParseData can be used again, without the errors of the
+	// last document.
+	if _, err = gopp.ParseWithData(g, "Start", []byte("a b ; a c ; end"), pd); err == nil || err.Error() != `expected 'b' but found 'c' at 0:8` {
+		t.Errorf("Expected the statement to be recovered from, got %v.", err)
+	}
+	if _, err = gopp.ParseWithData(g, "Start", []byte("a b ; end"), pd); err != nil {
+		t.Errorf("Expected no errors from an earlier document, got %v.", err)
+	}
+}
@@ -15,9 +15,21 @@ type Grammar struct {
 	LexSteps []LexStep
 	Rules    []Rule
 	Symbols  []Symbol
+
+	// set by Compile, so that lookups don't have to scan.
+	index *grammarIndex
+}
+
+type grammarIndex struct {
+	rules   map[string][]Rule
+	symbols map[string]Symbol
 }
 
 func (g Grammar) RulesForName(name string) (rs []Rule) {
+	if g.index != nil {
+		rs = g.index.rules[name]
+		return
+	}
 	for _, rule := range g.Rules {
 		if rule.Name == name {
 			rs = append(rs, rule)
@@ -27,6 +39,10 @@ func (g Grammar) RulesForName(name string) (rs []Rule) {
 }
 
 func (g Grammar) Symbol(name string) (s Symbol, ok bool) {
+	if g.index != nil {
+		s, ok = g.index.symbols[name]
+		return
+	}
 	for _, symb := range g.Symbols {
 		if symb.Name == name {
 			s = symb
@@ -37,6 +53,41 @@ func (g Grammar) Symbol(name string) (s Symbol, ok bool) {
 	return
 }
 
+// A CompiledGrammar is a Grammar with its token regexps compiled and its rules
+// and symbols indexed by name, so it can be used to parse many documents
+// without redoing that work. The Grammar must not be changed once compiled.
+type CompiledGrammar struct {
+	Grammar
+	TokenizeInfo TokenizeInfo
+}
+
+func Compile(g Grammar) (cg *CompiledGrammar, err error) {
+	cg = &CompiledGrammar{}
+	cg.TokenizeInfo.TokenREs, err = g.TokenREs()
+	if err != nil {
+		return
+	}
+	cg.TokenizeInfo.IgnoreREs, err = g.IgnoreREs()
+	if err != nil {
+		return
+	}
+	index := &grammarIndex{
+		rules:   map[string][]Rule{},
+		symbols: map[string]Symbol{},
+	}
+	for _, rule := range g.Rules {
+		index.rules[rule.Name] = append(index.rules[rule.Name], rule)
+	}
+	for _, symb := range g.Symbols {
+		if _, ok := index.symbols[symb.Name]; !ok {
+			index.symbols[symb.Name] = symb
+		}
+	}
+	cg.Grammar = g
+	cg.Grammar.index = index
+	return
+}
+
 func (g Grammar) CollectLiterals(literals map[string]bool) {
 	for _, rule := range g.Rules {
 		rule.CollectLiterals(literals)
@@ -155,6 +206,21 @@ func (gt GroupTerm) String() string {
 	return fmt.Sprintf("GroupTerm(%v)", gt.Expr)
 }
 
+type AlternationTerm struct {
+	Exprs []Expr
+}
+
+func (at AlternationTerm) String() string {
+	return fmt.Sprintf("AlternationTerm(%v)", at.Exprs)
+}
+
+func (at AlternationTerm) CollectLiterals(literals map[string]bool) {
+	for _, expr := range at.Exprs {
+		expr.CollectLiterals(literals)
+	}
+	return
+}
+
 type noLiterals struct{}
 
 func (n noLiterals) CollectLiterals(literals map[string]bool) {
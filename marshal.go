@@ -0,0 +1,292 @@
+// Copyright 2013 The gopp AUTHORS. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gopp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MarshalJSON writes the AST as JSON. Subtrees are arrays, and leaves are
+// objects: {"tag": "field=X"}, {"literal": "=>"}, {"symbol": "identifier",
+// "text": "X"}, and {"error": {...}, "skipped": [...]} for an ErrorNode, with
+// its ParseError and skipped Tokens as encoding/json writes them.
+func (ast AST) MarshalJSON() (data []byte, err error) {
+	v, err := jsonValue([]Node(ast))
+	if err != nil {
+		return
+	}
+	return json.Marshal(v)
+}
+
+func jsonValue(node Node) (v interface{}, err error) {
+	switch node := node.(type) {
+	case []Node:
+		list := []interface{}{}
+		for _, child := range node {
+			var cv interface{}
+			if cv, err = jsonValue(child); err != nil {
+				return
+			}
+			list = append(list, cv)
+		}
+		v = list
+	case AST:
+		return jsonValue([]Node(node))
+	case Tag:
+		v = map[string]interface{}{"tag": string(node)}
+	case Literal:
+		v = map[string]interface{}{"literal": string(node)}
+	case SymbolText:
+		v = map[string]interface{}{"symbol": node.Type, "text": node.Text}
+	case ErrorNode:
+		v = map[string]interface{}{"error": node.ParseError, "skipped": node.Skipped}
+	default:
+		err = fmt.Errorf("Cannot marshal node %T.", node)
+	}
+	return
+}
+
+// UnmarshalJSON reads an AST written by MarshalJSON.
+func (ast *AST) UnmarshalJSON(data []byte) (err error) {
+	node, err := jsonNode(data)
+	if err != nil {
+		return
+	}
+	nodes, ok := node.([]Node)
+	if !ok {
+		return fmt.Errorf("AST must be a list, not %v.", node)
+	}
+	*ast = AST(nodes)
+	return
+}
+
+func jsonNode(data []byte) (node Node, err error) {
+	data = bytes.TrimSpace(data)
+	if len(data) != 0 && data[0] == '[' {
+		var raws []json.RawMessage
+		if err = json.Unmarshal(data, &raws); err != nil {
+			return
+		}
+		nodes := []Node{}
+		for _, raw := range raws {
+			var child Node
+			if child, err = jsonNode(raw); err != nil {
+				return
+			}
+			nodes = append(nodes, child)
+		}
+		node = nodes
+		return
+	}
+
+	var leaf struct {
+		Tag     *string
+		Literal *string
+		Symbol  *string
+		Text    string
+		Error   *ParseError
+		Skipped []Token
+	}
+	if err = json.Unmarshal(data, &leaf); err != nil {
+		return
+	}
+	switch {
+	case leaf.Tag != nil:
+		node = Tag(*leaf.Tag)
+	case leaf.Literal != nil:
+		node = Literal(*leaf.Literal)
+	case leaf.Symbol != nil:
+		node = SymbolText{Type: *leaf.Symbol, Text: leaf.Text}
+	case leaf.Error != nil:
+		node = ErrorNode{leaf.Error, leaf.Skipped}
+	default:
+		err = fmt.Errorf("Unknown AST node %s.", data)
+	}
+	return
+}
+
+// MarshalSexp writes the AST as an S-expression, using gopp notation for the
+// leaves. Subtrees are parenthesized lists, tags are written {field=X},
+// literals '=>', and symbols <identifier:"X">. Each subtree starts a new,
+// indented line, so the output can be read and compared line by line.
+// ErrorNodes can't be written as S-expressions; use JSON for those.
+func MarshalSexp(ast AST) (data []byte, err error) {
+	var buf bytes.Buffer
+	if err = writeSexp(&buf, []Node(ast), 0); err != nil {
+		return
+	}
+	buf.WriteByte('\n')
+	data = buf.Bytes()
+	return
+}
+
+func writeSexp(buf *bytes.Buffer, nodes []Node, depth int) (err error) {
+	buf.WriteByte('(')
+	// leaves go on the same line, unless they follow a subtree.
+	afterSubtree := false
+	for i, node := range nodes {
+		sub, isSubtree := node.([]Node)
+		if ast, isAST := node.(AST); isAST {
+			sub, isSubtree = []Node(ast), true
+		}
+		if isSubtree || afterSubtree {
+			buf.WriteString("\n" + strings.Repeat("  ", depth+1))
+		} else if i != 0 {
+			buf.WriteByte(' ')
+		}
+		afterSubtree = isSubtree
+		switch node := node.(type) {
+		case []Node, AST:
+			err = writeSexp(buf, sub, depth+1)
+		case Tag:
+			if strings.ContainsAny(string(node), "}\n") {
+				err = fmt.Errorf("Cannot write tag %q as an S-expression.", string(node))
+			}
+			buf.WriteString("{" + string(node) + "}")
+		case Literal:
+			buf.WriteString("'" + strings.Replace(escapeString(string(node)), "'", `\x27`, -1) + "'")
+		case SymbolText:
+			buf.WriteString("<" + node.Type + ":" + strconv.Quote(node.Text) + ">")
+		case ErrorNode:
+			err = fmt.Errorf("Cannot write %v as an S-expression.", node)
+		default:
+			err = fmt.Errorf("Cannot marshal node %T.", node)
+		}
+		if err != nil {
+			return
+		}
+	}
+	buf.WriteByte(')')
+	return
+}
+
+// UnmarshalSexp reads an AST written by MarshalSexp.
+func UnmarshalSexp(data []byte) (ast AST, err error) {
+	sr := &sexpReader{data: data}
+	sr.skipSpace()
+	if sr.peek() != '(' {
+		err = sr.unexpected()
+		return
+	}
+	nodes, err := sr.list()
+	if err != nil {
+		return
+	}
+	sr.skipSpace()
+	if sr.i != len(sr.data) {
+		err = sr.unexpected()
+		return
+	}
+	ast = AST(nodes)
+	return
+}
+
+type sexpReader struct {
+	data []byte
+	i    int
+}
+
+func (sr *sexpReader) peek() byte {
+	if sr.i >= len(sr.data) {
+		return 0
+	}
+	return sr.data[sr.i]
+}
+
+func (sr *sexpReader) skipSpace() {
+	for sr.i < len(sr.data) && strings.IndexByte(" \t\r\n", sr.data[sr.i]) != -1 {
+		sr.i++
+	}
+}
+
+func (sr *sexpReader) unexpected() error {
+	if sr.i >= len(sr.data) {
+		return fmt.Errorf("S-expression ends too soon.")
+	}
+	return fmt.Errorf("Unexpected %q at offset %d in S-expression.", sr.data[sr.i], sr.i)
+}
+
+// until reads up to the next end, which is skipped. If escapes is set,
+// backslashes escape the byte after them.
+func (sr *sexpReader) until(end byte, escapes bool) (text string, err error) {
+	start := sr.i
+	for sr.i < len(sr.data) && sr.data[sr.i] != end {
+		if escapes && sr.data[sr.i] == '\\' {
+			sr.i++
+		}
+		sr.i++
+	}
+	if sr.i >= len(sr.data) {
+		err = sr.unexpected()
+		return
+	}
+	text = string(sr.data[start:sr.i])
+	sr.i++
+	return
+}
+
+// list reads a parenthesized list, starting at the '('.
+func (sr *sexpReader) list() (nodes []Node, err error) {
+	sr.i++
+	nodes = []Node{}
+	for {
+		sr.skipSpace()
+		var node Node
+		switch sr.peek() {
+		case ')':
+			sr.i++
+			return
+		case '(':
+			node, err = sr.list()
+		case '{':
+			sr.i++
+			var tag string
+			tag, err = sr.until('}', false)
+			node = Tag(tag)
+		case '\'':
+			sr.i++
+			var raw, literal string
+			if raw, err = sr.until('\'', true); err == nil {
+				if literal, err = descapeString(raw); err != nil {
+					err = fmt.Errorf("Bad literal '%s' in S-expression.", raw)
+				}
+			}
+			node = Literal(literal)
+		case '<':
+			node, err = sr.symbol()
+		default:
+			err = sr.unexpected()
+		}
+		if err != nil {
+			return
+		}
+		nodes = append(nodes, node)
+	}
+}
+
+// symbol reads a symbol like <identifier:"X">, starting at the '<'.
+func (sr *sexpReader) symbol() (st SymbolText, err error) {
+	sr.i++
+	if st.Type, err = sr.until(':', false); err != nil {
+		return
+	}
+	quoted, err := strconv.QuotedPrefix(string(sr.data[sr.i:]))
+	if err != nil {
+		err = sr.unexpected()
+		return
+	}
+	st.Text, _ = strconv.Unquote(quoted)
+	sr.i += len(quoted)
+	if sr.peek() != '>' {
+		err = sr.unexpected()
+		return
+	}
+	sr.i++
+	return
+}
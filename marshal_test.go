@@ -0,0 +1,99 @@
+// Copyright 2013 The gopp AUTHORS. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gopp
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestMarshalRoundTrip(t *testing.T) {
+	data, err := json.Marshal(ByHandGoppAST)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var fromJSON AST
+	if err = json.Unmarshal(data, &fromJSON); err != nil {
+		t.Error(err)
+		return
+	}
+	if ok, indices := compareNodes(ByHandGoppAST, fromJSON); !ok {
+		t.Errorf("AST from JSON doesn't match at %v.", indices)
+	}
+
+	data, err = MarshalSexp(ByHandGoppAST)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	fromSexp, err := UnmarshalSexp(data)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if ok, indices := compareNodes(ByHandGoppAST, fromSexp); !ok {
+		t.Errorf("AST from S-expression doesn't match at %v.", indices)
+	}
+}
+
+func TestMarshalForms(t *testing.T) {
+	ast := AST{
+		Tag("type=Eqn"),
+		Tag("field=Left"),
+		[]Node{Tag("field=N"), SymbolText{"number", "5"}},
+		Literal("'='"),
+		[]Node{},
+		Literal("\n"),
+	}
+	expectedJSON := `[{"tag":"type=Eqn"},{"tag":"field=Left"},[{"tag":"field=N"},{"symbol":"number","text":"5"}],{"literal":"'='"},[],{"literal":"\n"}]`
+	data, err := json.Marshal(ast)
+	if err != nil || string(data) != expectedJSON {
+		t.Errorf("Expected %s, got %s, %v.", expectedJSON, data, err)
+	}
+	expectedSexp := `({type=Eqn} {field=Left}
+  ({field=N} <number:"5">)
+  '\x27=\x27'
+  ()
+  '\n')
+`
+	data, err = MarshalSexp(ast)
+	if err != nil || string(data) != expectedSexp {
+		t.Errorf("Expected %s, got %s, %v.", expectedSexp, data, err)
+	}
+	read, err := UnmarshalSexp([]byte(expectedSexp))
+	if err != nil || !reflect.DeepEqual(read, ast) {
+		t.Errorf("Expected %v, got %v, %v.", ast, read, err)
+	}
+
+	// error nodes only survive JSON.
+	pe := &ParseError{Row: 1, Col: 2, Offset: 3, Expected: []string{"'x'"}}
+	withError := AST{ErrorNode{pe, []Token{{Type: "RAW", Raw: "y", Text: "y", Offset: 3}}}}
+	data, err = json.Marshal(withError)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var fromJSON AST
+	if err = json.Unmarshal(data, &fromJSON); err != nil || !reflect.DeepEqual(fromJSON, withError) {
+		t.Errorf("Expected %v, got %v, %v.", withError, fromJSON, err)
+	}
+	if _, err = MarshalSexp(withError); err == nil {
+		t.Errorf("Expected an error writing an ErrorNode as an S-expression.")
+	}
+
+	bad := []string{
+		"({field=X} <number:5>)",
+		"({field=X}",
+		"(x)",
+		"() ()",
+	}
+	for _, b := range bad {
+		if _, err = UnmarshalSexp([]byte(b)); err == nil {
+			t.Errorf("Expected an error reading %q.", b)
+		}
+	}
+}
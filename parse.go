@@ -12,45 +12,78 @@ import (
 )
 
 func Parse(g Grammar, startRule string, document []byte) (ast AST, err error) {
-	tokenREs, err := g.TokenREs()
-	if err != nil {
-		return
-	}
-	ignoreREs, err := g.IgnoreREs()
+	return ParseWithData(g, startRule, document, NewParseData())
+}
+
+// ParseWithData is like Parse, but uses the provided ParseData, so that
+// memoization can be configured and its statistics examined afterwards. The
+// same ParseData can be used for more than one document, and only tells about
+// the last.
+func ParseWithData(g Grammar, startRule string, document []byte, pd *ParseData) (ast AST, err error) {
+	cg, err := Compile(g)
 	if err != nil {
 		return
 	}
-	ti := TokenizeInfo{
-		TokenREs:  tokenREs,
-		IgnoreREs: ignoreREs,
-	}
-	tokens, err := Tokenize(ti, document)
+	ast, err = cg.ParseWithData(startRule, document, pd)
+	return
+}
+
+func (cg *CompiledGrammar) Parse(startRule string, document []byte) (ast AST, err error) {
+	return cg.ParseWithData(startRule, document, NewParseData())
+}
+
+func (cg *CompiledGrammar) ParseWithData(startRule string, document []byte, pd *ParseData) (ast AST, err error) {
+	tokens, err := Tokenize(cg.TokenizeInfo, document)
 	if err != nil {
 		return
 	}
-	rules := g.RulesForName(startRule)
-	if len(rules) != 1 {
-		err = fmt.Errorf("Rule %q had %d definitions.", startRule, len(rules))
-		return
-	}
-	start := rules[0]
-	pd := NewParseData()
-	items, remaining, err := start.Parse(g, tokens, pd, []string{})
+	pd.documentEnd = len(document)
+	ast, err = cg.parseAll(startRule, tokens, pd)
+	return
+}
 
+// parseAll parses the tokens of an entire document.
+func (cg *CompiledGrammar) parseAll(startRule string, tokens []Token, pd *ParseData) (ast AST, err error) {
+	items, remaining, err := cg.parseTokens(startRule, tokens, pd)
 	if err != nil {
-		// TODO: use pd to return informative error messages.
-		err = pd.FarthestErrors[0]
 		return
 	}
 	if len(remaining) != 0 {
-		err = errors.New("Did not parse entire file.")
+		err = recoveredErrors(items, pd.parseError(tokens, remaining, true))
+		return
 	}
+	// the AST is still returned with any errors recovered from, so the error
+	// nodes in it can be examined.
+	err = recoveredErrors(items, nil)
+	pd.Positions = newPositions(items, tokens)
 
 	ast = items
 
 	return
 }
 
+// parseTokens matches the start rule against as many of the tokens as it can.
+func (cg *CompiledGrammar) parseTokens(startRule string, tokens []Token, pd *ParseData) (items []Node, remaining []Token, err error) {
+	rules := cg.RulesForName(startRule)
+	if len(rules) != 1 {
+		err = fmt.Errorf("Rule %q had %d definitions.", startRule, len(rules))
+		return
+	}
+	pd.reset()
+	items, remaining, err = pd.parseRules(cg.Grammar, startRule, rules, tokens, []string{})
+	if err == nil {
+		pd.nameRule(items, startRule)
+	}
+	// drop what was built while backtracking, so it can be collected.
+	pd.keepNames(items)
+	pd.memo, pd.growing = nil, nil
+	// with nothing expected, the problem is with the grammar, not the document.
+	if err != nil && pd.expected != nil {
+		err = recoveredErrors(nil, pd.parseError(tokens, tokens, false))
+	}
+	return
+}
+
 const debug = false
 
 func SetTr(e bool) {
@@ -65,6 +98,108 @@ type ParseData struct {
 	errored              bool
 	FarthestErrors       []error
 	TokensForError       []Token
+
+	// NoMemo turns off the memo table, so rules are reparsed every time they
+	// are reached.
+	NoMemo bool
+	// MemoHits and MemoMisses count how often a rule's result at a given
+	// position was found in, or had to be added to, the memo table.
+	MemoHits, MemoMisses int
+
+	// Positions is filled in after a successful parse, and tells where each
+	// part of the AST came from.
+	Positions *Positions
+
+	// ruleNames holds the subtrees made by rules, keeping them so that their
+	// keys can't be reused by others. Once parsing is done, only those in the
+	// result are kept.
+	ruleNames map[nodesKey]namedNodes
+
+	memo    map[memoKey]memoEntry
+	growing map[memoKey]*seed
+	cycles  int
+
+	ruleStack     []string
+	expected      map[string]bool
+	expectedAt    int
+	expectedRules []string
+
+	// reached is the fewest tokens remaining when something was expected,
+	// within the rule currently being parsed.
+	reached     int
+	documentEnd int
+}
+
+// Positions are identified by the number of tokens remaining, which is
+// unique within a single document.
+type memoKey struct {
+	name      string
+	remaining int
+}
+
+type memoEntry struct {
+	items           []Node
+	remainingTokens []Token
+	err             error
+	reached         int
+}
+
+// A seed is the best parse so far of a left-recursive rule at some position.
+// It starts out as a failure, and is grown by reparsing the rule with the
+// previous seed standing in for the recursive reference, until that stops
+// consuming more tokens.
+type seed struct {
+	memoEntry
+	uses int
+}
+
+type namedNodes struct {
+	nodes []Node
+	name  string
+}
+
+func (pd *ParseData) nameRule(nodes []Node, name string) {
+	if len(nodes) == 0 {
+		return
+	}
+	if pd.ruleNames == nil {
+		pd.ruleNames = map[nodesKey]namedNodes{}
+	}
+	pd.ruleNames[keyFor(nodes)] = namedNodes{nodes, name}
+}
+
+// keepNames forgets the names of subtrees that aren't part of items, such as
+// those from alternatives that failed.
+func (pd *ParseData) keepNames(items []Node) {
+	names := pd.ruleNames
+	pd.ruleNames = nil
+	var walk func(nodes []Node)
+	walk = func(nodes []Node) {
+		if nn, ok := names[keyFor(nodes)]; ok {
+			pd.nameRule(nodes, nn.name)
+		}
+		for _, node := range nodes {
+			switch node := node.(type) {
+			case []Node:
+				walk(node)
+			case AST:
+				walk([]Node(node))
+			}
+		}
+	}
+	walk(items)
+}
+
+// RuleName returns the name of the rule that made the subtree nodes, which
+// must come from an AST parsed with pd. Only the root of the AST and subtrees
+// from <<Name>> terms are made by rules, and empty ones can't be told apart.
+func (pd *ParseData) RuleName(nodes []Node) (name string, ok bool) {
+	if pd == nil || len(nodes) == 0 {
+		return
+	}
+	nn, ok := pd.ruleNames[keyFor(nodes)]
+	name = nn.name
+	return
 }
 
 func NewParseData() (pd *ParseData) {
@@ -72,6 +207,17 @@ func NewParseData() (pd *ParseData) {
 	return
 }
 
+// reset forgets what was found parsing any earlier document, so that pd can
+// be used again. The memo statistics keep counting.
+func (pd *ParseData) reset() {
+	*pd = ParseData{
+		NoMemo:      pd.NoMemo,
+		MemoHits:    pd.MemoHits,
+		MemoMisses:  pd.MemoMisses,
+		documentEnd: pd.documentEnd,
+	}
+}
+
 func (pd *ParseData) AcceptUpTo(remaining []Token) {
 	if !pd.accepted || len(remaining) < len(pd.LastUnacceptedTokens) {
 		pd.LastUnacceptedTokens = remaining
@@ -87,6 +233,99 @@ func (pd *ParseData) ErrorWith(err error, remaining []Token) {
 	pd.errored = true
 }
 
+// parseRules tries each of the rules, all named name, in order, and returns
+// the items from the first that succeeds. Results are memoized by name and
+// position, unless pd.NoMemo is set. Left-recursive rules are handled by
+// growing a seed, as described by Warth et al. in "Packrat Parsers Can
+// Support Left Recursion".
+func (pd *ParseData) parseRules(g Grammar, name string, rules []Rule, tokens []Token, parentRuleNames []string) (items []Node, remainingTokens []Token, err error) {
+	key := memoKey{name, len(tokens)}
+
+	// If this rule is already being parsed here, we've recursed without
+	// consuming any tokens, and the current seed is all there is to use.
+	if s, ok := pd.growing[key]; ok {
+		s.uses++
+		pd.cycles++
+		items, remainingTokens, err = s.items, s.remainingTokens, s.err
+		return
+	}
+
+	if !pd.NoMemo {
+		if entry, ok := pd.memo[key]; ok {
+			pd.MemoHits++
+			items, remainingTokens, err = entry.items, entry.remainingTokens, entry.err
+			if entry.reached < pd.reached {
+				pd.reached = entry.reached
+			}
+			return
+		}
+	}
+
+	if pd.growing == nil {
+		pd.growing = map[memoKey]*seed{}
+	}
+	s := &seed{}
+	s.err = fmt.Errorf("Rule cycle with %q.", name)
+	pd.growing[key] = s
+
+	pd.ruleStack = append(pd.ruleStack, name)
+	reached := pd.reached
+	pd.reached = len(tokens)
+	defer func() {
+		pd.ruleStack = pd.ruleStack[:len(pd.ruleStack)-1]
+		if reached < pd.reached {
+			pd.reached = reached
+		}
+	}()
+
+	cycles := pd.cycles
+	items, remainingTokens, err = pd.tryRules(g, rules, tokens, parentRuleNames)
+	for err == nil && s.uses != 0 {
+		s.items, s.remainingTokens, s.err = items, remainingTokens, err
+		growItems, growTokens, growErr := pd.tryRules(g, rules, tokens, parentRuleNames)
+		if growErr != nil || len(growTokens) >= len(remainingTokens) {
+			break
+		}
+		items, remainingTokens = growItems, growTokens
+	}
+	delete(pd.growing, key)
+	// Now that the seed is done growing, the uses of it are settled.
+	pd.cycles -= s.uses
+
+	// If the rules got somewhere before failing, and say where it's safe to
+	// pick up again, skip ahead to there instead.
+	if err != nil && pd.reached < len(tokens) {
+		if sync, ok := syncLiteral(rules); ok {
+			if rItems, rTokens, ok := pd.recover(sync, tokens); ok {
+				items, remainingTokens, err = rItems, rTokens, nil
+			}
+		}
+	}
+
+	if !pd.NoMemo {
+		pd.MemoMisses++
+		// If the seed of some other rule still growing here was used, the
+		// result depends on that seed, and can't be reused later.
+		if pd.cycles == cycles {
+			if pd.memo == nil {
+				pd.memo = map[memoKey]memoEntry{}
+			}
+			pd.memo[key] = memoEntry{items, remainingTokens, err, pd.reached}
+		}
+	}
+	return
+}
+
+func (pd *ParseData) tryRules(g Grammar, rules []Rule, tokens []Token, parentRuleNames []string) (items []Node, remainingTokens []Token, err error) {
+	for _, rule := range rules {
+		items, remainingTokens, err = rule.Parse(g, tokens, pd, parentRuleNames)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
 func (r Rule) Parse(g Grammar, tokens []Token, pd *ParseData, parentRuleNames []string) (items []Node, remainingTokens []Token, err error) {
 	rName := fmt.Sprintf("Rule(%q)", r.Name)
 	tr.In(rName, tokens)
@@ -98,13 +337,6 @@ func (r Rule) Parse(g Grammar, tokens []Token, pd *ParseData, parentRuleNames []
 		}
 	}()
 
-	for _, n := range parentRuleNames {
-		if n == r.Name {
-			err = fmt.Errorf("Rule cycle with %q.", r.Name)
-			return
-		}
-	}
-
 	items, remainingTokens, err = r.Expr.Parse(g, tokens, pd, append(parentRuleNames, r.Name))
 	return
 }
@@ -162,6 +394,10 @@ func (t RepeatZeroTerm) Parse(g Grammar, tokens []Token, pd *ParseData, parentRu
 		if suberr != nil {
 			break
 		}
+		// a term that consumes nothing would match here forever.
+		if len(subtokens) == len(remainingTokens) {
+			break
+		}
 		myitems = append(myitems, subitems...)
 		remainingTokens = subtokens
 	}
@@ -184,6 +420,7 @@ func (t RepeatOneTerm) Parse(g Grammar, tokens []Token, pd *ParseData, parentRul
 	var myitems []Node
 	first := true
 	var suberr error
+	count := 0
 	for {
 		var prns []string
 		if first {
@@ -196,14 +433,24 @@ func (t RepeatOneTerm) Parse(g Grammar, tokens []Token, pd *ParseData, parentRul
 		if suberr != nil {
 			break
 		}
+		// a term that consumes nothing would match here forever, so it's
+		// only kept if it's needed for the one match.
+		if len(subtokens) == len(remainingTokens) && count != 0 {
+			break
+		}
 		myitems = append(myitems, subitems...)
 		remainingTokens = subtokens
+		count++
+		if len(subtokens) == len(tokens) {
+			break
+		}
 	}
-	items = []Node{myitems}
-	if len(items) == 0 {
+	if count == 0 {
 		err = suberr
 		pd.ErrorWith(err, tokens)
+		return
 	}
+	items = []Node{myitems}
 	return
 }
 
@@ -228,6 +475,34 @@ func (t OptionalTerm) Parse(g Grammar, tokens []Token, pd *ParseData, parentRule
 	return
 }
 
+func (t AlternationTerm) Parse(g Grammar, tokens []Token, pd *ParseData, parentRuleNames []string) (items []Node, remainingTokens []Token, err error) {
+	rName := fmt.Sprintf("AlternationTerm")
+	tr.In(rName, tokens)
+	defer func() {
+		if err == nil {
+			tr.Out(rName, items)
+		} else {
+			tr.Out(rName, err)
+		}
+	}()
+
+	if len(t.Exprs) == 0 {
+		err = errors.New("Alternation with no choices.")
+		pd.ErrorWith(err, tokens)
+		return
+	}
+
+	// the first choice that parses wins, just like a set of rules with the same name.
+	for _, expr := range t.Exprs {
+		items, remainingTokens, err = expr.Parse(g, tokens, pd, parentRuleNames)
+		if err == nil {
+			return
+		}
+	}
+
+	return
+}
+
 func (t RuleTerm) Parse(g Grammar, tokens []Token, pd *ParseData, parentRuleNames []string) (items []Node, remainingTokens []Token, err error) {
 	rName := fmt.Sprintf("RuleTerm(%q)", t.Name)
 	tr.In(rName, tokens)
@@ -247,17 +522,10 @@ func (t RuleTerm) Parse(g Grammar, tokens []Token, pd *ParseData, parentRuleName
 	}
 
 	var subitems []Node
-	//fmt.Printf("%d rules for %q.\n", len(rules), t.Name)
-	for _, rule := range rules {
-		// if tt, ok := rule.Expr[0].(TagTerm); ok {
-		// 	fmt.Printf("Trying %q.\n", tt.Tag)
-		// }
-		subitems, remainingTokens, err = rule.Parse(g, tokens, pd, parentRuleNames)
-
-		if err == nil {
-			items = []Node{subitems}
-			return
-		}
+	subitems, remainingTokens, err = pd.parseRules(g, t.Name, rules, tokens, parentRuleNames)
+	if err == nil {
+		items = []Node{subitems}
+		pd.nameRule(subitems, t.Name)
 	}
 
 	return
@@ -275,15 +543,15 @@ func (t InlineRuleTerm) Parse(g Grammar, tokens []Token, pd *ParseData, parentRu
 	}()
 
 	rules := g.RulesForName(t.Name)
-	for _, rule := range rules {
-		items, remainingTokens, err = rule.Parse(g, tokens, pd, parentRuleNames)
-
+	if len(rules) != 0 {
+		items, remainingTokens, err = pd.parseRules(g, t.Name, rules, tokens, parentRuleNames)
 		if err == nil {
 			return
 		}
 	}
 	err = nil
 	if _, ok := g.Symbol(t.Name); ok {
+		pd.expect("<"+t.Name+">", tokens)
 		if len(tokens) < 1 {
 			err = errors.New("Need at least one token to make a symbol.")
 			pd.ErrorWith(err, tokens)
@@ -328,6 +596,7 @@ func (t LiteralTerm) Parse(g Grammar, tokens []Token, pd *ParseData, parentRuleN
 		}
 	}()
 
+	pd.expect(quoteLiteral(t.Literal), tokens)
 	if len(tokens) == 0 {
 		err = fmt.Errorf("Expected %q at EOF.", t.Literal)
 		pd.ErrorWith(err, tokens)
@@ -40,6 +40,21 @@ Z = /(z)/
 			Case{`y`, &XYZ{}, &XYZ{Y: "y"}},
 		},
 	},
+	Subject{
+		Name: "AlternationTest",
+		Gopp: `
+Start => {field=X} <X> ({field=Y} <Y> | {field=Z} <Z>) [{field=Y} <Y> | 'w']
+X = /(x)/
+Y = /(y)/
+Z = /(z)/
+`,
+		Cases: []Case{
+			Case{`xy`, &XYZ{}, &XYZ{X: "x", Y: "y"}},
+			Case{`xz`, &XYZ{}, &XYZ{X: "x", Z: "z"}},
+			Case{`xzy`, &XYZ{}, &XYZ{X: "x", Y: "y", Z: "z"}},
+			Case{`xzw`, &XYZ{}, &XYZ{X: "x", Z: "z"}},
+		},
+	},
 }
 
 func TestSubjects(t *testing.T) {
@@ -64,3 +79,21 @@ subject:
 		}
 	}
 }
+
+func TestRepeatOneNeedsOne(t *testing.T) {
+	g, err := gopp.NewGrammar(`
+Start => 'x' <<Y>>+ 'z'
+Y => 'y'
+`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err = gopp.Parse(g, "Start", []byte("xyyz")); err != nil {
+		t.Error(err)
+	}
+	// a '+' that matches nothing fails, rather than matching zero times.
+	if _, err = gopp.Parse(g, "Start", []byte("xz")); err == nil || err.Error() != `expected 'y' but found 'z' at 0:1` {
+		t.Errorf("Expected <<Y>>+ to need a match, got %v.", err)
+	}
+}
@@ -146,3 +146,124 @@ func TestMathPrecedence(t *testing.T) {
 		t.Errorf("Expected %q, got %q.", expectedEqn, eqn)
 	}
 }
+
+const mathalternationgopp = `
+Eqn => {type=MathEqn} {field=Left} <<Expr>> '=' {field=Right} <<Expr>> '\n'
+Expr => {type=MathSum} {field=First} <<Term>> '+' {field=Second} <<Term>> | <Term>
+Term => {type=MathProduct} {field=First} <<Factor>> '*' {field=Second} <<Factor>> | <Factor>
+Factor => {type=MathExprFactor} '(' {field=Expr} <<Expr>> ')' | {type=MathNumberFactor} {field=Number} <number>
+number = /(\d+)/
+`
+
+func TestMathAlternation(t *testing.T) {
+	df, err := gopp.NewDecoderFactory(mathalternationgopp, "Eqn")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	df.RegisterType(MathExprFactor{})
+	df.RegisterType(MathNumberFactor{})
+	df.RegisterType(MathSum{})
+	df.RegisterType(MathProduct{})
+	dec := df.NewDecoder(strings.NewReader("(5+5)*2=6*2+3\n"))
+	var eqn MathEqn
+	err = dec.Decode(&eqn)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	expectedEqn := MathEqn{
+		Left: MathProduct{
+			MathExprFactor{
+				MathSum{
+					MathNumberFactor{5},
+					MathNumberFactor{5},
+				},
+			},
+			MathNumberFactor{2},
+		},
+		Right: MathSum{
+			MathProduct{
+				MathNumberFactor{6},
+				MathNumberFactor{2},
+			},
+			MathNumberFactor{3},
+		},
+	}
+
+	if eqn != expectedEqn {
+		t.Errorf("Expected %q, got %q.", expectedEqn, eqn)
+	}
+}
+
+const mathleftgopp = `
+Eqn => {type=MathEqn} {field=Left} <<Expr>> '=' {field=Right} <<Expr>> '\n'
+Expr => {type=MathDifference} {field=First} <<Expr>> '-' {field=Second} <<Term>>
+Expr => <Sum>
+Expr => <Term>
+Sum => {type=MathSum} {field=First} <<Expr>> '+' {field=Second} <<Term>>
+Term => {type=MathProduct} {field=First} <<Term>> '*' {field=Second} <<Factor>> | <Factor>
+Factor => {type=MathExprFactor} '(' {field=Expr} <<Expr>> ')' | {type=MathNumberFactor} {field=Number} <number>
+number = /(\d+)/
+`
+
+type MathDifference struct {
+	First, Second interface{}
+}
+
+func (d MathDifference) String() string {
+	return fmt.Sprintf("%d-%d", d.First, d.Second)
+}
+
+func TestMathLeftRecursion(t *testing.T) {
+	df, err := gopp.NewDecoderFactory(mathleftgopp, "Eqn")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	df.RegisterType(MathExprFactor{})
+	df.RegisterType(MathNumberFactor{})
+	df.RegisterType(MathSum{})
+	df.RegisterType(MathDifference{})
+	df.RegisterType(MathProduct{})
+	dec := df.NewDecoder(strings.NewReader("9-3-2=1+2*3*4+(5-6)\n"))
+	var eqn MathEqn
+	err = dec.Decode(&eqn)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	expectedEqn := MathEqn{
+		Left: MathDifference{
+			MathDifference{
+				MathNumberFactor{9},
+				MathNumberFactor{3},
+			},
+			MathNumberFactor{2},
+		},
+		Right: MathSum{
+			MathSum{
+				MathNumberFactor{1},
+				MathProduct{
+					MathProduct{
+						MathNumberFactor{2},
+						MathNumberFactor{3},
+					},
+					MathNumberFactor{4},
+				},
+			},
+			MathExprFactor{
+				MathDifference{
+					MathNumberFactor{5},
+					MathNumberFactor{6},
+				},
+			},
+		},
+	}
+
+	if eqn != expectedEqn {
+		t.Errorf("Expected %q, got %q.", expectedEqn, eqn)
+	}
+}
@@ -5,6 +5,7 @@
 package gopp
 
 import (
+	"bytes"
 	"fmt"
 	"reflect"
 	"regexp"
@@ -22,12 +23,14 @@ func TestFixedPointDecoder(t *testing.T) {
 	df.RegisterType(RepeatOneTerm{})
 	df.RegisterType(OptionalTerm{})
 	df.RegisterType(GroupTerm{})
+	df.RegisterType(AlternationTerm{})
 	df.RegisterType(RuleTerm{})
 	df.RegisterType(InlineRuleTerm{})
 	df.RegisterType(TagTerm{})
 	df.RegisterType(LiteralTerm{})
 	var g Grammar
 	dec := df.NewDecoder(strings.NewReader(goppgopp))
+	dec.Strict()
 	err = dec.Decode(&g)
 	if err != nil {
 		t.Error(err)
@@ -40,7 +43,11 @@ func TestFixedPointDecoder(t *testing.T) {
 	}
 
 	// now see if the just-populated grammar can generate itself
-	df.g = g
+	df.g, err = Compile(g)
+	if err != nil {
+		t.Error(err)
+		return
+	}
 	dec = df.NewDecoder(strings.NewReader(goppgopp))
 	var g2 Grammar
 	err = dec.Decode(&g2)
@@ -66,6 +73,7 @@ func TestDecodeGrammar(t *testing.T) {
 	sa.RegisterType(RepeatOneTerm{})
 	sa.RegisterType(OptionalTerm{})
 	sa.RegisterType(GroupTerm{})
+	sa.RegisterType(AlternationTerm{})
 	sa.RegisterType(RuleTerm{})
 	sa.RegisterType(InlineRuleTerm{})
 	sa.RegisterType(TagTerm{})
@@ -128,6 +136,19 @@ func compareTerms(t1, t2 Term) (err error) {
 		err = compareTerms(t1.Term, t2.(RepeatZeroTerm).Term)
 	case RepeatOneTerm:
 		err = compareTerms(t1.Term, t2.(RepeatOneTerm).Term)
+	case GroupTerm:
+		err = compareExprs(t1.Expr, t2.(GroupTerm).Expr)
+	case AlternationTerm:
+		if len(t1.Exprs) != len(t2.(AlternationTerm).Exprs) {
+			err = fmt.Errorf("Alternation lengths %d and %d don't match.", len(t1.Exprs), len(t2.(AlternationTerm).Exprs))
+			return
+		}
+		for i := range t1.Exprs {
+			err = compareExprs(t1.Exprs[i], t2.(AlternationTerm).Exprs[i])
+			if err != nil {
+				return
+			}
+		}
 	case LiteralTerm:
 		if t1.Literal != t2.(LiteralTerm).Literal {
 			err = fmt.Errorf("Literals %q and %q don't match.", t1.Literal, t2.(LiteralTerm).Literal)
@@ -247,53 +268,78 @@ var rulesTextAndByHand = []textByHand{
 	},
 	{
 		"Term.1",
-		`Term => <Term1>`,
+		`Term => <Alternation>`,
 		getGoppASTRules(ByHandGoppAST)[5],
 	},
 	{
 		"Term.2",
-		`Term => <Term2>`,
+		`Term => <Term1>`,
 		getGoppASTRules(ByHandGoppAST)[6],
 	},
+	{
+		"Term.3",
+		`Term => <Term2>`,
+		getGoppASTRules(ByHandGoppAST)[7],
+	},
+	{
+		"Alternation",
+		`Alternation => {type=AlternationTerm} {field=Exprs} <<Sequence>> {field=.} ('|' {field=Exprs} <<Sequence>>)+`,
+		getGoppASTRules(ByHandGoppAST)[8],
+	},
+	{
+		"Sequence",
+		`Sequence => <<SequenceTerm>>+`,
+		getGoppASTRules(ByHandGoppAST)[9],
+	},
+	{
+		"SequenceTerm.1",
+		`SequenceTerm => <Term1>`,
+		getGoppASTRules(ByHandGoppAST)[10],
+	},
+	{
+		"SequenceTerm.2",
+		`SequenceTerm => <Term2>`,
+		getGoppASTRules(ByHandGoppAST)[11],
+	},
 	{
 		"Term1.1",
 		`Term1 => {type=RepeatZeroTerm} {field=Term} <<Term2>> '*'`,
-		getGoppASTRules(ByHandGoppAST)[7],
+		getGoppASTRules(ByHandGoppAST)[12],
 	},
 	{
 		"Term1.2",
 		`Term1 => {type=RepeatOneTerm} {field=Term} <<Term2>> '+'`,
-		getGoppASTRules(ByHandGoppAST)[8],
+		getGoppASTRules(ByHandGoppAST)[13],
 	},
 	{
 		"Term2.1",
 		`Term2 => {type=OptionalTerm} '[' {field=Expr} <Expr> ']'`,
-		getGoppASTRules(ByHandGoppAST)[9],
+		getGoppASTRules(ByHandGoppAST)[14],
 	},
 	{
 		"Term2.2",
 		`Term2 => {type=GroupTerm} '(' {field=Expr} <Expr> ')'`,
-		getGoppASTRules(ByHandGoppAST)[10],
+		getGoppASTRules(ByHandGoppAST)[15],
 	},
 	{
 		"Term2.3",
 		`Term2 => {type=RuleTerm} '<<' {field=Name} <identifier> '>>'`,
-		getGoppASTRules(ByHandGoppAST)[11],
+		getGoppASTRules(ByHandGoppAST)[16],
 	},
 	{
 		"Term2.4",
 		`Term2 => {type=InlineRuleTerm} '<' {field=Name} <identifier> '>'`,
-		getGoppASTRules(ByHandGoppAST)[12],
+		getGoppASTRules(ByHandGoppAST)[17],
 	},
 	{
 		"Term2.5",
 		`Term2 => {type=TagTerm} {field=Tag} <tag>`,
-		getGoppASTRules(ByHandGoppAST)[13],
+		getGoppASTRules(ByHandGoppAST)[18],
 	},
 	{
 		"Term2.6",
 		`Term2 => {type=LiteralTerm} {field=Literal} <literal>`,
-		getGoppASTRules(ByHandGoppAST)[14],
+		getGoppASTRules(ByHandGoppAST)[19],
 	},
 }
 
@@ -584,3 +630,214 @@ func TestParseLiteral(t *testing.T) {
 		return
 	}
 }
+
+func TestParseAlternation(t *testing.T) {
+	byHandAST := mkGrammar(
+		[]Node{},
+		[]Node{
+			mkRule("X",
+				mkAlternationTerm(
+					mkExpr(mkLiteralTerm("("), mkRuleTerm("X"), mkLiteralTerm(")")),
+					mkExpr(mkInlineRuleTerm("w")),
+				),
+			),
+			mkRule("Z",
+				mkRepeatOneTerm(mkGroupTerm(
+					mkAlternationTerm(
+						mkExpr(mkLiteralTerm("y")),
+						mkExpr(mkLiteralTerm("z")),
+					),
+				)),
+			),
+		},
+		[]Node{
+			mkSymbol("w", "w"),
+		},
+	)
+
+	tokens, err := Tokenize(ByHandTokenInfo, []byte(`
+X => '(' <<X>> ')' | <w>
+Z => ('y' | 'z')+
+w = /w/
+`))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	start := ByHandGrammar.RulesForName("Grammar")[0]
+	pd := &ParseData{}
+	items, remaining, err := start.Parse(ByHandGrammar, tokens, pd, []string{})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(remaining) != 0 {
+		t.Errorf("Leftover tokens: %v.", remaining)
+	}
+
+	ok, indices := compareNodes(byHandAST, AST(items))
+	if !ok {
+		t.Errorf("Generated AST doesn't match by-hand AST at %v.", indices)
+	}
+}
+
+func TestParseMemo(t *testing.T) {
+	pd := NewParseData()
+	memoAST, err := ParseWithData(ByHandGrammar, "Grammar", []byte(goppgopp), pd)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if pd.MemoHits == 0 || pd.MemoMisses == 0 {
+		t.Errorf("Expected memo hits and misses, got %d and %d.", pd.MemoHits, pd.MemoMisses)
+	}
+
+	pd = NewParseData()
+	pd.NoMemo = true
+	plainAST, err := ParseWithData(ByHandGrammar, "Grammar", []byte(goppgopp), pd)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if pd.MemoHits != 0 || pd.MemoMisses != 0 {
+		t.Errorf("Expected no memo hits or misses, got %d and %d.", pd.MemoHits, pd.MemoMisses)
+	}
+
+	ok, indices := compareNodes(plainAST, memoAST)
+	if !ok {
+		t.Errorf("Memoized AST doesn't match unmemoized AST at %v.", indices)
+	}
+}
+
+func TestCompiledGrammar(t *testing.T) {
+	cg, err := Compile(ByHandGrammar)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, rule := range ByHandGrammar.Rules {
+		indexed := cg.RulesForName(rule.Name)
+		scanned := ByHandGrammar.RulesForName(rule.Name)
+		if len(indexed) != len(scanned) {
+			t.Errorf("Got %d rules for %q, expected %d.", len(indexed), rule.Name, len(scanned))
+		}
+	}
+	for _, symb := range ByHandGrammar.Symbols {
+		if _, ok := cg.Symbol(symb.Name); !ok {
+			t.Errorf("Could not find symbol %q.", symb.Name)
+		}
+	}
+	if _, ok := cg.Symbol("Grammar"); ok {
+		t.Errorf("Found symbol %q, which is a rule.", "Grammar")
+	}
+
+	// the same compiled grammar can be used again and again.
+	for i := 0; i < 3; i++ {
+		ast, err := cg.Parse("Grammar", []byte(goppgopp))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ok, indices := compareNodes(ByHandGoppAST, ast)
+		if !ok {
+			t.Errorf("Generated AST doesn't match by-hand AST at %v.", indices)
+		}
+	}
+}
+
+func TestPositions(t *testing.T) {
+	pd := NewParseData()
+	ast, err := ParseWithData(ByHandGrammar, "Grammar", []byte("X=>'y'\nw=/z/\n"), pd)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	rules := ast[5].([]Node)
+	span, ok := pd.Positions.OfChild(rules, 0)
+	expected := Span{Pos{0, 0, 0}, Pos{1, 0, 7}}
+	if !ok || span != expected {
+		t.Errorf("Expected rule at %v, got %v.", expected, span)
+	}
+	span, ok = pd.Positions.OfChild(rules[0].([]Node), 2)
+	expected = Span{Pos{0, 1, 1}, Pos{0, 3, 3}}
+	if !ok || span != expected {
+		t.Errorf("Expected literal at %v, got %v.", expected, span)
+	}
+	symbols := ast[7].([]Node)
+	span, ok = pd.Positions.Of(symbols)
+	expected = Span{Pos{1, 0, 7}, Pos{2, 0, 13}}
+	if !ok || span != expected {
+		t.Errorf("Expected symbols at %v, got %v.", expected, span)
+	}
+	if _, ok = pd.Positions.Of(ast[3].([]Node)); ok {
+		t.Errorf("Expected no position for the empty lex steps.")
+	}
+}
+
+func TestEncodeGrammar(t *testing.T) {
+	df, err := NewDecoderFactory(goppgopp, "Grammar")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	df.RegisterType(RepeatZeroTerm{})
+	df.RegisterType(RepeatOneTerm{})
+	df.RegisterType(OptionalTerm{})
+	df.RegisterType(GroupTerm{})
+	df.RegisterType(AlternationTerm{})
+	df.RegisterType(RuleTerm{})
+	df.RegisterType(InlineRuleTerm{})
+	df.RegisterType(TagTerm{})
+	df.RegisterType(LiteralTerm{})
+
+	var buf bytes.Buffer
+	enc := df.NewEncoder(&buf)
+	err = enc.Encode(&ByHandGrammar)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var g Grammar
+	dec := df.NewDecoder(&buf)
+	dec.Strict()
+	err = dec.Decode(&g)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = compareGrammars(g, ByHandGrammar)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRuleNamesKept(t *testing.T) {
+	g, err := NewGrammar(`
+ignore: /^\s+/
+Start => <<Choice>>
+Choice => <<Pair>> 'x'
+Choice => <<Pair>> 'y'
+Pair => <w> <w>
+w = /([a-z])/
+`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// without the memo table, Pair is parsed again after the first Choice
+	// fails, and only the second one should still be named.
+	pd := NewParseData()
+	pd.NoMemo = true
+	ast, err := ParseWithData(g, "Start", []byte("a b y"), pd)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(pd.ruleNames) != 3 {
+		t.Errorf("Expected names for Start, Choice and Pair, got %d.", len(pd.ruleNames))
+	}
+	pair := ast[0].([]Node)[0].([]Node)
+	if name, _ := pd.RuleName(pair); name != "Pair" {
+		t.Errorf("Expected %v to be a Pair, got %q.", pair, name)
+	}
+}
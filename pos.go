@@ -0,0 +1,157 @@
+// Copyright 2013 The gopp AUTHORS. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gopp
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// A Pos is a location in a document. Row and Col count from zero, as they do
+// for a Token, with Col counting runes. Offset is in bytes.
+type Pos struct {
+	Row, Col int
+	Offset   int
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%d:%d", p.Row, p.Col)
+}
+
+// A Span is the part of a document from Start up to, but not including, End.
+type Span struct {
+	Start, End Pos
+}
+
+func (s Span) String() string {
+	return fmt.Sprintf("%v-%v", s.Start, s.End)
+}
+
+func tokenStart(t Token) Pos {
+	return Pos{Row: t.Row, Col: t.Col, Offset: t.Offset}
+}
+
+func tokenEnd(t Token) (p Pos) {
+	p = tokenStart(t)
+	p.Offset += len(t.Raw)
+	p.Row, p.Col = advance(p.Row, p.Col, []byte(t.Raw))
+	return
+}
+
+// Positions records where the parts of an AST came from in the document.
+// Leaves and subtrees are looked up by the []Node that holds them, keyed on
+// its backing array and length, so they must come from the same AST that was
+// parsed. Copying or re-slicing a []Node, or appending to it, gives it a
+// different key, and its position is lost.
+type Positions struct {
+	subtrees map[nodesKey]Span
+	leaves   map[leafKey]Span
+}
+
+type nodesKey struct {
+	data uintptr
+	len  int
+}
+
+type leafKey struct {
+	nodesKey
+	index int
+}
+
+func keyFor(nodes []Node) nodesKey {
+	return nodesKey{reflect.ValueOf(nodes).Pointer(), len(nodes)}
+}
+
+// Of returns the span of the subtree nodes. Subtrees with no literals or
+// symbols in them, such as those with only tags, have no span.
+func (p *Positions) Of(nodes []Node) (span Span, ok bool) {
+	if p == nil || len(nodes) == 0 {
+		return
+	}
+	span, ok = p.subtrees[keyFor(nodes)]
+	return
+}
+
+// OfChild returns the span of nodes[i], which may be a leaf or a subtree.
+func (p *Positions) OfChild(nodes []Node, i int) (span Span, ok bool) {
+	if p == nil || i < 0 || i >= len(nodes) {
+		return
+	}
+	switch child := nodes[i].(type) {
+	case []Node:
+		return p.Of(child)
+	case AST:
+		return p.Of([]Node(child))
+	}
+	span, ok = p.leaves[leafKey{keyFor(nodes), i}]
+	return
+}
+
+// newPositions matches up the leaves of the AST with the tokens they were
+// parsed from. Every literal and symbol consumed exactly one token, and
+// every error node the tokens it skipped, all in document order.
+func newPositions(ast AST, tokens []Token) *Positions {
+	pr := &positioner{
+		Positions: &Positions{
+			subtrees: map[nodesKey]Span{},
+			leaves:   map[leafKey]Span{},
+		},
+		tokens: tokens,
+	}
+	pr.walk([]Node(ast))
+	return pr.Positions
+}
+
+type positioner struct {
+	*Positions
+	tokens []Token
+	next   int
+}
+
+func (pr *positioner) walk(nodes []Node) (span Span, ok bool) {
+	for i := range nodes {
+		child, childOK := pr.child(nodes, i)
+		if !childOK {
+			continue
+		}
+		if !ok {
+			span.Start = child.Start
+			ok = true
+		}
+		span.End = child.End
+	}
+	if ok {
+		pr.subtrees[keyFor(nodes)] = span
+	}
+	return
+}
+
+func (pr *positioner) child(nodes []Node, i int) (span Span, ok bool) {
+	switch node := nodes[i].(type) {
+	case []Node:
+		return pr.walk(node)
+	case AST:
+		return pr.walk([]Node(node))
+	case Literal, SymbolText:
+		span, ok = pr.take(1)
+	case ErrorNode:
+		span, ok = pr.take(len(node.Skipped))
+	}
+	if ok {
+		pr.leaves[leafKey{keyFor(nodes), i}] = span
+	}
+	return
+}
+
+// take consumes the next n tokens, returning their span.
+func (pr *positioner) take(n int) (span Span, ok bool) {
+	if n == 0 || pr.next+n > len(pr.tokens) {
+		return
+	}
+	span = Span{tokenStart(pr.tokens[pr.next]), tokenEnd(pr.tokens[pr.next+n-1])}
+	pr.next += n
+	ok = true
+	return
+}
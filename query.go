@@ -0,0 +1,389 @@
+// Copyright 2013 The gopp AUTHORS. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gopp
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Selector picks nodes out of an AST, in the manner of a CSS selector. It
+// is a list of steps, each of which matches one kind of node. A step of *
+// matches any node, [] any subtree, <name> a symbol of type name, or any
+// symbol with <*>, 'text' the literal text, with Go escapes, and {tag} the
+// tag, like {field=Expr}. A bare Name matches a subtree made by the rule Name,
+// which is only known with the ParseData.
+//
+// Steps are separated by a space, when the next step matches anything inside
+// a node matched by the previous one, '>', when it matches only its
+// children, or '+', when it matches only the node right after it. A step may
+// be followed by any of :first, :last, :nth(i) and :depth(d), to match only
+// the first, last or ith node in its subtree, or nodes in d subtrees. The
+// root of the AST has depth 0.
+//
+// For example, "{field=Expr} + [] <identifier>" matches the identifiers
+// anywhere in the subtrees that come just after {field=Expr} tags.
+type Selector struct {
+	expr  string
+	steps []selectorStep
+}
+
+type selectorStep struct {
+	// combinator is how the step relates to the one before it: ' ', '>' or
+	// '+', and 0 for the first step.
+	combinator byte
+	kind       byte
+	text       string
+	pseudos    []selectorPseudo
+}
+
+type selectorPseudo struct {
+	name string
+	n    int
+}
+
+// Query returns the nodes in ast matched by the selector expr, in document
+// order.
+func Query(ast AST, expr string) (nodes []Node, err error) {
+	return QueryWithData(ast, nil, expr)
+}
+
+// QueryWithData is like Query, but uses the ParseData that ast was parsed
+// with, so that rule names can be matched.
+func QueryWithData(ast AST, pd *ParseData, expr string) (nodes []Node, err error) {
+	s, err := CompileSelector(expr)
+	if err != nil {
+		return
+	}
+	nodes = s.SelectWithData(ast, pd)
+	return
+}
+
+func (s *Selector) String() string {
+	return s.expr
+}
+
+// CompileSelector parses expr into a Selector that can be used many times.
+// It returns an error if expr is empty, starts with '>' or '+', has a
+// character that can't start or continue a step, or ends in the middle of
+// one. A literal with an escape that can't be read, an argument to :nth or
+// :depth that isn't a number, and an unknown pseudo-class are errors too.
+func CompileSelector(expr string) (s *Selector, err error) {
+	s = &Selector{expr: expr}
+	sp := &selectorParser{expr: expr}
+	for {
+		spaced := sp.skipSpace()
+		if sp.done() {
+			break
+		}
+		step := selectorStep{}
+		switch c := sp.peek(); {
+		case c == '>' || c == '+':
+			step.combinator = c
+			sp.i++
+			sp.skipSpace()
+		case spaced && len(s.steps) != 0:
+			step.combinator = ' '
+		}
+		if step.combinator != 0 && len(s.steps) == 0 {
+			err = fmt.Errorf("Selector %q starts with %q.", expr, step.combinator)
+			return
+		}
+		if step.combinator == 0 && len(s.steps) != 0 {
+			// steps must be separated.
+			err = sp.unexpected()
+			return
+		}
+		if err = sp.step(&step); err != nil {
+			return
+		}
+		s.steps = append(s.steps, step)
+	}
+	if len(s.steps) == 0 {
+		err = fmt.Errorf("Selector %q is empty.", expr)
+	}
+	return
+}
+
+type selectorParser struct {
+	expr string
+	i    int
+}
+
+func (sp *selectorParser) done() bool {
+	return sp.i >= len(sp.expr)
+}
+
+func (sp *selectorParser) peek() byte {
+	if sp.done() {
+		return 0
+	}
+	return sp.expr[sp.i]
+}
+
+func (sp *selectorParser) skipSpace() (skipped bool) {
+	for !sp.done() && strings.IndexByte(" \t\n", sp.peek()) != -1 {
+		sp.i++
+		skipped = true
+	}
+	return
+}
+
+func (sp *selectorParser) unexpected() error {
+	if sp.done() {
+		return fmt.Errorf("Selector %q ends too soon.", sp.expr)
+	}
+	return fmt.Errorf("Unexpected %q at %d in selector %q.", sp.peek(), sp.i, sp.expr)
+}
+
+// until reads up to the next end, which is skipped. Backslashes escape the
+// character after them.
+func (sp *selectorParser) until(end byte) (text string, err error) {
+	start := sp.i
+	for !sp.done() && sp.peek() != end {
+		if sp.peek() == '\\' {
+			sp.i++
+		}
+		sp.i++
+	}
+	if sp.done() {
+		err = sp.unexpected()
+		return
+	}
+	text = sp.expr[start:sp.i]
+	sp.i++
+	return
+}
+
+func (sp *selectorParser) identifier() string {
+	start := sp.i
+	for !sp.done() {
+		c := sp.peek()
+		if c != '_' && !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') && !('0' <= c && c <= '9' && sp.i != start) {
+			break
+		}
+		sp.i++
+	}
+	return sp.expr[start:sp.i]
+}
+
+func (sp *selectorParser) step(step *selectorStep) (err error) {
+	c := sp.peek()
+	switch c {
+	case '*':
+		sp.i++
+	case '[':
+		sp.i++
+		if sp.peek() != ']' {
+			return sp.unexpected()
+		}
+		sp.i++
+	case '<':
+		sp.i++
+		if step.text, err = sp.until('>'); err != nil {
+			return
+		}
+	case '{':
+		sp.i++
+		if step.text, err = sp.until('}'); err != nil {
+			return
+		}
+	case '\'':
+		sp.i++
+		var raw string
+		if raw, err = sp.until('\''); err != nil {
+			return
+		}
+		if step.text, err = descapeString(raw); err != nil {
+			return fmt.Errorf("Bad literal '%s' in selector %q.", raw, sp.expr)
+		}
+	default:
+		if step.text = sp.identifier(); step.text == "" {
+			return sp.unexpected()
+		}
+		c = 'r'
+	}
+	step.kind = c
+
+	for sp.peek() == ':' {
+		sp.i++
+		pseudo := selectorPseudo{name: sp.identifier()}
+		switch pseudo.name {
+		case "first", "last":
+		case "nth", "depth":
+			if sp.peek() != '(' {
+				return sp.unexpected()
+			}
+			sp.i++
+			var arg string
+			if arg, err = sp.until(')'); err != nil {
+				return
+			}
+			if pseudo.n, err = strconv.Atoi(strings.TrimSpace(arg)); err != nil {
+				return fmt.Errorf("Bad argument %q to :%s in selector %q.", arg, pseudo.name, sp.expr)
+			}
+		default:
+			return fmt.Errorf("Unknown :%s in selector %q.", pseudo.name, sp.expr)
+		}
+		step.pseudos = append(step.pseudos, pseudo)
+	}
+	return
+}
+
+// Select returns the nodes in ast matched by s, in document order.
+func (s *Selector) Select(ast AST) (nodes []Node) {
+	return s.SelectWithData(ast, nil)
+}
+
+// SelectWithData is like Select, but uses the ParseData that ast was parsed
+// with, so that rule names can be matched.
+func (s *Selector) SelectWithData(ast AST, pd *ParseData) (nodes []Node) {
+	entries := indexNodes(ast, pd)
+	var matched []int
+	for i := range entries {
+		if s.steps[0].matches(entries, i) {
+			matched = append(matched, i)
+		}
+	}
+	for _, step := range s.steps[1:] {
+		next := map[int]bool{}
+		for _, i := range matched {
+			e := entries[i]
+			switch step.combinator {
+			case ' ':
+				for j := i + 1; j < e.end; j++ {
+					if step.matches(entries, j) {
+						next[j] = true
+					}
+				}
+			case '>':
+				for _, j := range e.children {
+					if step.matches(entries, j) {
+						next[j] = true
+					}
+				}
+			case '+':
+				if e.parent == -1 {
+					continue
+				}
+				siblings := entries[e.parent].children
+				if e.index+1 < len(siblings) && step.matches(entries, siblings[e.index+1]) {
+					next[siblings[e.index+1]] = true
+				}
+			}
+		}
+		matched = matched[:0]
+		for j := range next {
+			matched = append(matched, j)
+		}
+		sort.Ints(matched)
+	}
+	for _, i := range matched {
+		nodes = append(nodes, entries[i].node)
+	}
+	return
+}
+
+func (step selectorStep) matches(entries []queryEntry, i int) bool {
+	e := entries[i]
+	switch step.kind {
+	case '*':
+	case '[':
+		if !e.subtree {
+			return false
+		}
+	case 'r':
+		if !e.subtree || e.rule != step.text {
+			return false
+		}
+	case '<':
+		st, ok := e.node.(SymbolText)
+		if !ok || (step.text != "*" && st.Type != step.text) {
+			return false
+		}
+	case '\'':
+		if l, ok := e.node.(Literal); !ok || string(l) != step.text {
+			return false
+		}
+	case '{':
+		if t, ok := e.node.(Tag); !ok || string(t) != step.text {
+			return false
+		}
+	}
+	for _, pseudo := range step.pseudos {
+		switch pseudo.name {
+		case "first":
+			if e.index != 0 {
+				return false
+			}
+		case "last":
+			if e.parent != -1 && e.index != len(entries[e.parent].children)-1 {
+				return false
+			}
+		case "nth":
+			if e.index != pseudo.n {
+				return false
+			}
+		case "depth":
+			if e.depth != pseudo.n {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// A queryEntry is a node of an AST, along with where it is. Entries are kept
+// in document order, so a subtree's entry is followed by those of everything
+// in it.
+type queryEntry struct {
+	node Node
+	// parent is the index of the parent's entry, or -1 for the root.
+	parent       int
+	index, depth int
+	subtree      bool
+	rule         string
+	children     []int
+	end          int
+}
+
+func indexNodes(ast AST, pd *ParseData) (entries []queryEntry) {
+	var stack []int
+	WalkWithData(ast, pd, VisitorFuncs{
+		EnterFunc: func(node Node, ws *WalkState) bool {
+			e := queryEntry{
+				node:   node,
+				parent: -1,
+				depth:  ws.Depth(),
+			}
+			if len(stack) != 0 {
+				e.parent = stack[len(stack)-1]
+				e.index = ws.Indices[len(ws.Indices)-1]
+				entries[e.parent].children = append(entries[e.parent].children, len(entries))
+			}
+			var nodes []Node
+			switch n := node.(type) {
+			case AST:
+				nodes, e.subtree = []Node(n), true
+			case []Node:
+				nodes, e.subtree = n, true
+			}
+			if e.subtree {
+				e.rule, _ = pd.RuleName(nodes)
+			}
+			stack = append(stack, len(entries))
+			entries = append(entries, e)
+			return true
+		},
+		LeaveFunc: func(node Node, ws *WalkState) {
+			i := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			entries[i].end = len(entries)
+		},
+	})
+	return
+}
@@ -0,0 +1,72 @@
+// Copyright 2013 The gopp AUTHORS. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gopp_test
+
+import (
+	"fmt"
+	"github.com/skelterjohn/gopp"
+	"testing"
+)
+
+func TestQuery(t *testing.T) {
+	pd := gopp.NewParseData()
+	document := "X => 'y' <<Z>>\nZ => <w> {t}\nw = /w/\n"
+	ast, err := gopp.ParseWithData(gopp.ByHandGrammar, "Grammar", []byte(document), pd)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cases := []struct {
+		expr     string
+		expected string
+	}{
+		{"<identifier>", "[<identifier:\"X\"> <identifier:\"Z\"> <identifier:\"Z\"> <identifier:\"w\"> <identifier:\"w\">]"},
+		{"Symbol <identifier>", "[<identifier:\"w\">]"},
+		{"Rule > <identifier>", "[<identifier:\"X\"> <identifier:\"Z\">]"},
+		{"'<<' + {field=Name} + <*>", "[<identifier:\"Z\">]"},
+		{"Term > <*>:last", "[<literal:\"y\"> <tag:\"t\">]"},
+		{"Rule:nth(1) '\\n'", "[Literal(\\n)]"},
+		{"{field=Expr}:depth(3)", "[Tag(field=Expr) Tag(field=Expr)]"},
+		{"Rule:first > <identifier>", "[<identifier:\"X\">]"},
+		{"{type=RuleTerm} + *", "[Literal(<<)]"},
+	}
+	for _, c := range cases {
+		nodes, err := gopp.QueryWithData(ast, pd, c.expr)
+		if err != nil {
+			t.Errorf("With %q, got error %v.", c.expr, err)
+			continue
+		}
+		if got := fmt.Sprint(nodes); got != c.expected {
+			t.Errorf("With %q, expected %s, got %s.", c.expr, c.expected, got)
+		}
+	}
+
+	// rule names aren't known without the ParseData.
+	if nodes, err := gopp.Query(ast, "Symbol <identifier>"); err != nil || len(nodes) != 0 {
+		t.Errorf("Expected nothing without the ParseData, got %v, %v.", nodes, err)
+	}
+
+	bad := []struct {
+		expr string
+		err  string
+	}{
+		{"", `Selector "" is empty.`},
+		{"> <x>", `Selector "> <x>" starts with '>'.`},
+		{"Rule <x", `Selector "Rule <x" ends too soon.`},
+		{"Rule >", `Selector "Rule >" ends too soon.`},
+		{"Rule:second", `Unknown :second in selector "Rule:second".`},
+		{"[x]", `Unexpected 'x' at 1 in selector "[x]".`},
+		{"Rule<identifier>", `Unexpected '<' at 4 in selector "Rule<identifier>".`},
+		{"[]{field=Name}", `Unexpected '{' at 2 in selector "[]{field=Name}".`},
+		{"<identifier>'=>'", `Unexpected '\'' at 12 in selector "<identifier>'=>'".`},
+	}
+	for _, b := range bad {
+		_, err := gopp.Query(ast, b.expr)
+		if err == nil || err.Error() != b.err {
+			t.Errorf("With %q, expected error %q, got %v.", b.expr, b.err, err)
+		}
+	}
+}
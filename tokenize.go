@@ -5,28 +5,83 @@
 package gopp
 
 import (
+	"bytes"
 	"fmt"
 	"regexp"
 )
 
 type Token struct {
-	Type     string
-	Raw      string
-	Text     string
+	Type string
+	Raw  string
+	Text string
+	// Row and Col count from zero, and take everything before the token
+	// into account, including ignored text. Col counts runes, not bytes.
 	Row, Col int
+	// Offset is the byte offset of the token within the document.
+	Offset int
 }
 
 func (t Token) String() string {
 	return fmt.Sprintf("(%s: %q)", t.Type, t.Text)
 }
 
+// Trivia is a piece of ignored text, such as whitespace or a comment,
+// matched by one of the grammar's ignore patterns.
+type Trivia struct {
+	Raw      string
+	Row, Col int
+	Offset   int
+}
+
+// TokenTrivia holds the ignored text around one token.
+type TokenTrivia struct {
+	Leading, Trailing []Trivia
+}
+
+// A TokenizeError is returned when no token or ignore pattern matches the
+// document at some point.
+type TokenizeError struct {
+	Row, Col int
+	Offset   int
+	// Snippet is the start of the text that could not be matched.
+	Snippet string
+}
+
+func (te *TokenizeError) Error() string {
+	return fmt.Sprintf("Could not match starting from %q.", te.Snippet)
+}
+
 type TokenizeInfo struct {
 	TokenREs  []TypedRegexp
 	IgnoreREs []*regexp.Regexp
 }
 
 func Tokenize(ti TokenizeInfo, document []byte) (tokens []Token, err error) {
-	var row, col int
+	return tokenizeFrom(ti, document, Pos{})
+}
+
+// TokenizeTrivia is like Tokenize, but also returns the ignored text around
+// each token, in trivia, which lines up with tokens, so that the document can
+// be put back together. A token's trailing trivia runs up to and including the
+// first piece that ends a line, and anything after that, or after a token that
+// ends a line itself, leads the next token. Trivia after the last token is
+// returned as trailing.
+func TokenizeTrivia(ti TokenizeInfo, document []byte) (tokens []Token, trivia []TokenTrivia, trailing []Trivia, err error) {
+	return tokenize(ti, document, Pos{}, true)
+}
+
+// tokenizeFrom tokenizes a document that begins at start, for when it is
+// only the remainder of some larger input.
+func tokenizeFrom(ti TokenizeInfo, document []byte, start Pos) (tokens []Token, err error) {
+	tokens, _, _, err = tokenize(ti, document, start, false)
+	return
+}
+
+func tokenize(ti TokenizeInfo, document []byte, start Pos, keepTrivia bool) (tokens []Token, tokenTrivia []TokenTrivia, trivia []Trivia, err error) {
+	row, col, offset := start.Row, start.Col, start.Offset
+	// lineEnded is set once the last token or the trivia after it has ended
+	// a line, so that the rest leads the next token.
+	lineEnded := false
 tokenloop:
 	for len(document) != 0 {
 
@@ -45,7 +100,24 @@ tokenloop:
 				err = fmt.Errorf("Regexp matched text not at beginning: %s", re)
 				return
 			}
+			if keepTrivia {
+				t := Trivia{
+					Raw:    string(matches[0]),
+					Row:    row,
+					Col:    col,
+					Offset: offset,
+				}
+				if len(tokens) != 0 && !lineEnded {
+					last := &tokenTrivia[len(tokenTrivia)-1]
+					last.Trailing = append(last.Trailing, t)
+					lineEnded = bytes.Contains(matches[0], []byte("\n"))
+				} else {
+					trivia = append(trivia, t)
+				}
+			}
 			document = document[len(matches[0]):]
+			offset += len(matches[0])
+			row, col = advance(row, col, matches[0])
 			continue tokenloop
 		}
 
@@ -61,10 +133,11 @@ tokenloop:
 			capturedText := matches[1]
 
 			token := Token{
-				Type: re.Type,
-				Raw:  string(matchedText),
-				Row:  row,
-				Col:  col,
+				Type:   re.Type,
+				Raw:    string(matchedText),
+				Row:    row,
+				Col:    col,
+				Offset: offset,
 			}
 			if len(matches) > 1 {
 				token.Text = string(capturedText)
@@ -72,15 +145,14 @@ tokenloop:
 					return
 				}
 			}
-			for _, c := range matchedText {
-				if c == '\n' {
-					row++
-					col = 0
-				} else {
-					col++
-				}
-			}
+			row, col = advance(row, col, matchedText)
 			newdocument = document[len(matchedText):]
+			offset += len(matchedText)
+			if keepTrivia {
+				tokenTrivia = append(tokenTrivia, TokenTrivia{Leading: trivia})
+				trivia = nil
+			}
+			lineEnded = bytes.HasSuffix(matchedText, []byte("\n"))
 			tokens = append(tokens, token)
 			break
 		}
@@ -89,10 +161,28 @@ tokenloop:
 			if len(snippet) > 80 {
 				snippet = snippet[:80]
 			}
-			err = fmt.Errorf("Could not match starting from %q.", snippet)
+			err = &TokenizeError{
+				Row:     row,
+				Col:     col,
+				Offset:  offset,
+				Snippet: string(snippet),
+			}
 			return
 		}
 		document = newdocument
 	}
 	return
 }
+
+// advance moves row and col past text. Columns count runes, not bytes.
+func advance(row, col int, text []byte) (int, int) {
+	for _, c := range string(text) {
+		if c == '\n' {
+			row++
+			col = 0
+		} else {
+			col++
+		}
+	}
+	return row, col
+}
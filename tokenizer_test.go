@@ -26,6 +26,7 @@ func TestCollectLiterals(t *testing.T) {
 		">>",
 		"*",
 		"+",
+		"|",
 		"\n",
 	}
 
@@ -65,7 +66,7 @@ func TestSymbolTokenize(t *testing.T) {
 				continue
 			}
 			if len(tokens) == 0 {
-				t.Error("No tokens for %q.", example[0])
+				t.Errorf("No tokens for %q.", example[0])
 				continue
 			}
 			if typ != tokens[0].Type {
@@ -106,8 +107,13 @@ LexStep => {field=Name} <identifier> ':' {field=Pattern} <regexp> '\n'+
 Rule => {field=Name} <identifier> '=>' {field=Expr} <Expr> '\n'+
 Symbol => {field=Name} <identifier> '=' {field=Pattern} <regexp> '\n'+
 Expr => <<Term>>+
+Term => <Alternation>
 Term => <Term1>
 Term => <Term2>
+Alternation => {type=AlternationTerm} {field=Exprs} <<Sequence>> {field=.} ('|' {field=Exprs} <<Sequence>>)+
+Sequence => <<SequenceTerm>>+
+SequenceTerm => <Term1>
+SequenceTerm => <Term2>
 Term1 => {type=RepeatZeroTerm} {field=Term} <<Term2>> '*'
 Term1 => {type=RepeatOneTerm} {field=Term} <<Term2>> '+'
 Term2 => {type=OptionalTerm} '[' {field=Expr} <Expr> ']'
@@ -121,3 +127,34 @@ literal = /'((?:[\\']|[^'])+?)'/
 tag = /\{((?:[\\']|[^'])+?)\}/
 regexp = /\/((?:\\/|[^\n])+?)\//
 `
+
+func TestTokenPositions(t *testing.T) {
+	tokens, err := Tokenize(ByHandTokenInfo, []byte("# cömment\nX => 'é'\n  w = /z/\n"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expected := []struct {
+		text          string
+		row, col, off int
+	}{
+		{"X", 1, 0, 11},
+		{"=>", 1, 2, 13},
+		{"é", 1, 5, 16},
+		{"\n", 1, 8, 20},
+		{"w", 2, 2, 23},
+		{"=", 2, 4, 25},
+		{"z", 2, 6, 27},
+		{"\n", 2, 9, 30},
+	}
+	if len(tokens) != len(expected) {
+		t.Errorf("Expected %d tokens, got %d.", len(expected), len(tokens))
+		return
+	}
+	for i, e := range expected {
+		tok := tokens[i]
+		if tok.Text != e.text || tok.Row != e.row || tok.Col != e.col || tok.Offset != e.off {
+			t.Errorf("Expected %q at %d:%d (%d), got %q at %d:%d (%d).", e.text, e.row, e.col, e.off, tok.Text, tok.Row, tok.Col, tok.Offset)
+		}
+	}
+}
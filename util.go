@@ -42,26 +42,27 @@ func descapeString(s string) (r string, err error) {
 }
 
 func printNode(node Node, indentCount int) {
-	indent := func(tag string) {
-		for i := 0; i < indentCount; i++ {
+	indent := func(ws *WalkState, tag string) {
+		for i := 0; i < indentCount+ws.Depth(); i++ {
 			fmt.Print(" ")
 		}
 		fmt.Println(tag)
 	}
-	switch node := node.(type) {
-	case []Node:
-		indent("[")
-		for _, n := range node {
-			printNode(n, indentCount+1)
-		}
-		indent("]")
-	case AST:
-		indent("[")
-		for _, n := range node {
-			printNode(n, indentCount+1)
-		}
-		indent("]")
-	default:
-		indent(fmt.Sprint(node))
-	}
+	Walk(node, VisitorFuncs{
+		EnterFunc: func(node Node, ws *WalkState) bool {
+			switch node.(type) {
+			case []Node, AST:
+				indent(ws, "[")
+			default:
+				indent(ws, fmt.Sprint(node))
+			}
+			return true
+		},
+		LeaveFunc: func(node Node, ws *WalkState) {
+			switch node.(type) {
+			case []Node, AST:
+				indent(ws, "]")
+			}
+		},
+	})
 }
@@ -0,0 +1,367 @@
+// Copyright 2013 The gopp AUTHORS. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gopp
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+)
+
+// A GrammarError is a problem with a grammar found by Validate.
+type GrammarError struct {
+	// Name is the rule, symbol or lex step with the problem.
+	Name string
+	// Warning is set for problems that don't stop the grammar from working,
+	// like definitions that are never used.
+	Warning bool
+	Msg     string
+}
+
+func (ge *GrammarError) Error() string {
+	if ge.Warning {
+		return "warning: " + ge.Msg
+	}
+	return ge.Msg
+}
+
+// GrammarErrors holds everything Validate found, in the order of the
+// definitions they're about.
+type GrammarErrors []*GrammarError
+
+func (ges GrammarErrors) Error() string {
+	var msgs []string
+	for _, ge := range ges {
+		msgs = append(msgs, ge.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Warnings reports whether everything in ges is only a warning.
+func (ges GrammarErrors) Warnings() bool {
+	for _, ge := range ges {
+		if !ge.Warning {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate looks for mistakes in a grammar that would otherwise only show up
+// while parsing, if at all. It reports as errors
+//
+//   - references to rules or symbols that aren't defined,
+//   - names defined as both a rule and a symbol,
+//   - symbols defined more than once, since only the first is used,
+//   - regexps that don't compile, and symbols without a group to capture,
+//   - repetitions of something that can match without consuming anything,
+//
+// and as warnings
+//
+//   - rules that can't be reached from the start rule,
+//   - symbols that are never used,
+//   - symbols that can match a literal, which is always read as the literal
+//     since literals are tried first, and symbols that can't match anything
+//     because an earlier one always matches it instead,
+//   - ignore patterns not anchored with ^, and lex steps other than ignore,
+//   - rules that are left-recursive through other rules.
+//
+// If start is "", the first rule is used.
+func (g Grammar) Validate(start string) (errs GrammarErrors) {
+	v := &validator{g: g}
+	if start == "" && len(g.Rules) != 0 {
+		start = g.Rules[0].Name
+	}
+	if len(g.Rules) == 0 {
+		v.errorf("", "Grammar has no rules.")
+	} else if len(g.RulesForName(start)) == 0 {
+		v.errorf(start, "Start rule %q is not defined.", start)
+	}
+
+	v.lexSteps()
+	v.references()
+	v.reachable(start)
+	v.symbols()
+	v.analysis()
+	return v.errs
+}
+
+type validator struct {
+	g    Grammar
+	errs GrammarErrors
+}
+
+func (v *validator) errorf(name string, format string, args ...interface{}) {
+	v.errs = append(v.errs, &GrammarError{Name: name, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) warnf(name string, format string, args ...interface{}) {
+	v.errs = append(v.errs, &GrammarError{Name: name, Warning: true, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) lexSteps() {
+	for _, ls := range v.g.LexSteps {
+		if ls.Name != "ignore" {
+			v.warnf(ls.Name, "Lex step %q does nothing, since only ignore is used.", ls.Name)
+			continue
+		}
+		re, err := syntax.Parse(ls.Pattern, syntax.Perl)
+		if err != nil {
+			v.errorf(ls.Name, "Ignore pattern /%s/ doesn't compile: %v.", ls.Pattern, err)
+			continue
+		}
+		if !anchored(re) {
+			v.warnf(ls.Name, "Ignore pattern /%s/ isn't anchored with ^, so it may match after the start of the text.", ls.Pattern)
+		}
+	}
+}
+
+func anchored(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpBeginText, syntax.OpBeginLine:
+		return true
+	case syntax.OpConcat:
+		return len(re.Sub) != 0 && anchored(re.Sub[0])
+	case syntax.OpCapture:
+		return anchored(re.Sub[0])
+	case syntax.OpAlternate:
+		for _, sub := range re.Sub {
+			if !anchored(sub) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// forEachTerm calls f for each term in expr, and the terms inside them.
+func forEachTerm(expr Expr, f func(Term)) {
+	for _, term := range expr {
+		f(term)
+		switch t := term.(type) {
+		case RepeatZeroTerm:
+			forEachTerm(Expr{t.Term}, f)
+		case RepeatOneTerm:
+			forEachTerm(Expr{t.Term}, f)
+		case OptionalTerm:
+			forEachTerm(t.Expr, f)
+		case GroupTerm:
+			forEachTerm(t.Expr, f)
+		case AlternationTerm:
+			for _, sub := range t.Exprs {
+				forEachTerm(sub, f)
+			}
+		}
+	}
+}
+
+func (v *validator) references() {
+	reported := map[string]bool{}
+	for _, rule := range v.g.Rules {
+		forEachTerm(rule.Expr, func(term Term) {
+			var name, kind string
+			switch t := term.(type) {
+			case RuleTerm:
+				if len(v.g.RulesForName(t.Name)) != 0 {
+					return
+				}
+				name, kind = t.Name, "rule"
+			case InlineRuleTerm:
+				if len(v.g.RulesForName(t.Name)) != 0 {
+					return
+				}
+				if _, ok := v.g.Symbol(t.Name); ok {
+					return
+				}
+				name, kind = t.Name, "rule or symbol"
+			default:
+				return
+			}
+			if key := rule.Name + " " + name; !reported[key] {
+				reported[key] = true
+				v.errorf(rule.Name, "Rule %q refers to undefined %s %q.", rule.Name, kind, name)
+			}
+		})
+	}
+}
+
+func (v *validator) reachable(start string) {
+	reached := map[string]bool{}
+	var reach func(name string)
+	reach = func(name string) {
+		if reached[name] {
+			return
+		}
+		reached[name] = true
+		for _, rule := range v.g.RulesForName(name) {
+			forEachTerm(rule.Expr, func(term Term) {
+				switch t := term.(type) {
+				case RuleTerm:
+					reach(t.Name)
+				case InlineRuleTerm:
+					reach(t.Name)
+				}
+			})
+		}
+	}
+	reach(start)
+
+	reported := map[string]bool{}
+	for _, rule := range v.g.Rules {
+		if !reached[rule.Name] && !reported[rule.Name] && len(v.g.RulesForName(start)) != 0 {
+			reported[rule.Name] = true
+			v.warnf(rule.Name, "Rule %q can't be reached from %q.", rule.Name, start)
+		}
+	}
+}
+
+func (v *validator) symbols() {
+	used := map[string]bool{}
+	for _, rule := range v.g.Rules {
+		forEachTerm(rule.Expr, func(term Term) {
+			if t, ok := term.(InlineRuleTerm); ok {
+				used[t.Name] = true
+			}
+		})
+	}
+	literals := map[string]bool{}
+	v.g.CollectLiterals(literals)
+	var sortedLiterals []string
+	for literal := range literals {
+		sortedLiterals = append(sortedLiterals, literal)
+	}
+	sort.Strings(sortedLiterals)
+
+	defined := map[string]bool{}
+	var earlier []Symbol
+	var earlierREs []*regexp.Regexp
+	for _, symb := range v.g.Symbols {
+		if defined[symb.Name] {
+			v.errorf(symb.Name, "Symbol %q is defined more than once, and only the first is used.", symb.Name)
+			continue
+		}
+		defined[symb.Name] = true
+		if len(v.g.RulesForName(symb.Name)) != 0 {
+			v.errorf(symb.Name, "%q is both a rule and a symbol.", symb.Name)
+		} else if !used[symb.Name] {
+			v.warnf(symb.Name, "Symbol %q is never used.", symb.Name)
+		}
+
+		re, err := regexp.Compile("^" + symb.Pattern)
+		if err != nil {
+			v.errorf(symb.Name, "Symbol %q has pattern /%s/, which doesn't compile: %v.", symb.Name, symb.Pattern, err)
+			continue
+		}
+		if re.NumSubexp() == 0 {
+			v.errorf(symb.Name, "Symbol %q has pattern /%s/, with no group to capture its text.", symb.Name, symb.Pattern)
+		}
+		for _, literal := range sortedLiterals {
+			if re.FindString(literal) == literal {
+				v.warnf(symb.Name, "Symbol %q matches %s, which is always read as a literal instead.", symb.Name, quoteLiteral(literal))
+			}
+			// literals are tried first, so one that starts some longer text
+			// the symbol matches splits it, like 'if' does to "iffy".
+			if matchesPast(symb.Pattern, literal) {
+				v.warnf(symb.Name, "Symbol %q matches some text starting with %s, which is split off as a literal instead.", symb.Name, quoteLiteral(literal))
+			}
+		}
+		if text, ok := literalPattern(symb.Pattern); ok {
+			for i, ere := range earlierREs {
+				if ere.FindString(text) == text {
+					v.warnf(symb.Name, "Symbol %q can never match, since %q is read as <%s> first.", symb.Name, text, earlier[i].Name)
+					break
+				}
+			}
+		}
+		earlier = append(earlier, symb)
+		earlierREs = append(earlierREs, re)
+	}
+}
+
+// literalPattern finds the only text a pattern like /(if)/ can match.
+func literalPattern(pattern string) (text string, ok bool) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return
+	}
+	re = re.Simplify()
+	for {
+		if re.Op == syntax.OpConcat && len(re.Sub) > 1 && re.Sub[0].Op == syntax.OpBeginText {
+			re = &syntax.Regexp{Op: syntax.OpConcat, Sub: re.Sub[1:]}
+		} else if re.Op == syntax.OpCapture || re.Op == syntax.OpConcat && len(re.Sub) == 1 {
+			re = re.Sub[0]
+		} else {
+			break
+		}
+	}
+	if re.Op != syntax.OpLiteral || re.Flags&syntax.FoldCase != 0 {
+		return
+	}
+	return string(re.Rune), true
+}
+
+// matchesPast reports whether pattern, matched from the start of the text,
+// can match some text that begins with prefix and goes on past it. It steps
+// the compiled pattern through prefix, and sees if any way through is still
+// waiting for more. Assertions other than the start of the text are taken to
+// hold, so it may report text that can't actually be matched.
+func matchesPast(pattern, prefix string) bool {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return false
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return false
+	}
+	var add func(states map[uint32]bool, pc uint32, atStart bool)
+	add = func(states map[uint32]bool, pc uint32, atStart bool) {
+		if states[pc] {
+			return
+		}
+		states[pc] = true
+		inst := &prog.Inst[pc]
+		switch inst.Op {
+		case syntax.InstAlt, syntax.InstAltMatch:
+			add(states, inst.Out, atStart)
+			add(states, inst.Arg, atStart)
+		case syntax.InstCapture, syntax.InstNop:
+			add(states, inst.Out, atStart)
+		case syntax.InstEmptyWidth:
+			// there is always more text after the prefix, so the end of the
+			// text can't be matched.
+			empty := syntax.EmptyOp(inst.Arg)
+			if empty&syntax.EmptyEndText != 0 || !atStart && empty&syntax.EmptyBeginText != 0 {
+				return
+			}
+			add(states, inst.Out, atStart)
+		}
+	}
+	states := map[uint32]bool{}
+	add(states, uint32(prog.Start), true)
+	for _, r := range prefix {
+		next := map[uint32]bool{}
+		for pc := range states {
+			inst := &prog.Inst[pc]
+			switch inst.Op {
+			case syntax.InstRune, syntax.InstRune1, syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+				if inst.MatchRune(r) {
+					add(next, inst.Out, false)
+				}
+			}
+		}
+		states = next
+	}
+	for pc := range states {
+		switch prog.Inst[pc].Op {
+		case syntax.InstRune, syntax.InstRune1, syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+// Copyright 2013 The gopp AUTHORS. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gopp_test
+
+import (
+	"github.com/skelterjohn/gopp"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	if errs := gopp.ByHandGrammar.Validate("Grammar"); len(errs) != 0 {
+		t.Errorf("Expected the gopp grammar to be fine, got:\n%v", errs)
+	}
+
+	grammar := `
+ignore: /\s+/
+keep: /^x/
+Start => <<Stmt>>* <<Missing>>
+Stmt => 'if' <word> <nothing>
+Stmt => <<Start>> <num>
+Stmt => 'x' <dup>
+Orphan => <word>
+word = /([a-z]+)/
+num = /\d+/
+keyword = /(if)/
+unused = /(u)/
+Orphan = /(o)/
+dup = /(d)/
+dup = /(e)/
+broken = /(/
+`
+	g, err := gopp.NewGrammar(grammar)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	errs := g.Validate("")
+	expected := []string{
+		"warning: Ignore pattern /\\s+/ isn't anchored with ^, so it may match after the start of the text.",
+		`warning: Lex step "keep" does nothing, since only ignore is used.`,
+		`Rule "Start" refers to undefined rule "Missing".`,
+		`Rule "Stmt" refers to undefined rule or symbol "nothing".`,
+		`warning: Rule "Orphan" can't be reached from "Start".`,
+		`warning: Symbol "word" matches 'if', which is always read as a literal instead.`,
+		`warning: Symbol "word" matches some text starting with 'if', which is split off as a literal instead.`,
+		`warning: Symbol "word" matches 'x', which is always read as a literal instead.`,
+		`warning: Symbol "word" matches some text starting with 'x', which is split off as a literal instead.`,
+		`Symbol "num" has pattern /\d+/, with no group to capture its text.`,
+		`warning: Symbol "keyword" is never used.`,
+		`warning: Symbol "keyword" matches 'if', which is always read as a literal instead.`,
+		`warning: Symbol "keyword" can never match, since "if" is read as <word> first.`,
+		`warning: Symbol "unused" is never used.`,
+		`warning: Symbol "unused" can never match, since "u" is read as <word> first.`,
+		`"Orphan" is both a rule and a symbol.`,
+		`warning: Symbol "Orphan" can never match, since "o" is read as <word> first.`,
+		`warning: Symbol "dup" can never match, since "d" is read as <word> first.`,
+		`Symbol "dup" is defined more than once, and only the first is used.`,
+		`warning: Symbol "broken" is never used.`,
+		"Symbol \"broken\" has pattern /(/, which doesn't compile: error parsing regexp: missing closing ): `^(`.",
+		`warning: Rule "Start" is indirectly left-recursive, through Start -> Stmt -> Start.`,
+	}
+	for i := 0; i < len(errs) || i < len(expected); i++ {
+		var got, want string
+		if i < len(errs) {
+			got = errs[i].Error()
+		}
+		if i < len(expected) {
+			want = expected[i]
+		}
+		if got != want {
+			t.Errorf("Problem %d: expected %q, got %q.", i, want, got)
+		}
+	}
+	if errs.Warnings() {
+		t.Errorf("Expected some problems to be errors.")
+	}
+
+	// 'if' splits "iffy", but can't split anything <var> matches.
+	g, err = gopp.NewGrammar(`
+Start => 'if' <name> <var>
+name = /([a-z]{3,})/
+var = /(i\d+|if)/
+`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	errs = g.Validate("Start")
+	expected = []string{
+		`warning: Symbol "name" matches some text starting with 'if', which is split off as a literal instead.`,
+		`warning: Symbol "var" matches 'if', which is always read as a literal instead.`,
+	}
+	if len(errs) != len(expected) || errs[0].Error() != expected[0] || errs[1].Error() != expected[1] {
+		t.Errorf("Expected %q, got %v.", expected, errs)
+	}
+
+	if errs = g.Validate("Nope"); len(errs) == 0 || errs[0].Error() != `Start rule "Nope" is not defined.` {
+		t.Errorf("Expected the start rule to be missing, got %v.", errs)
+	}
+}
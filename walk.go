@@ -0,0 +1,112 @@
+// Copyright 2013 The gopp AUTHORS. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gopp
+
+// A Visitor is called by Walk for each node in an AST. Enter is called
+// before a subtree's children are walked, and Leave after, and both are
+// called for leaves as well. If Enter returns false for a subtree, its
+// children are skipped, but Leave is still called.
+type Visitor interface {
+	Enter(node Node, ws *WalkState) (descend bool)
+	Leave(node Node, ws *WalkState)
+}
+
+// WalkState tells a Visitor where in the AST the current node is.
+type WalkState struct {
+	// Parents holds the subtrees containing the current node, outermost
+	// first, and Indices holds the index of the next one down, or of the
+	// current node, in each.
+	Parents [][]Node
+	Indices []int
+	// Rules holds the name of the rule that made each of the Parents, or ""
+	// for those that weren't made by a rule, or when walking without the
+	// ParseData.
+	Rules []string
+
+	pd *ParseData
+}
+
+// Depth is how many subtrees contain the current node.
+func (ws *WalkState) Depth() int {
+	return len(ws.Parents)
+}
+
+// Parent returns the subtree containing the current node, or nil for the
+// root.
+func (ws *WalkState) Parent() []Node {
+	if len(ws.Parents) == 0 {
+		return nil
+	}
+	return ws.Parents[len(ws.Parents)-1]
+}
+
+// Rule returns the name of the innermost rule containing the current node,
+// if it is known.
+func (ws *WalkState) Rule() (name string, ok bool) {
+	for i := len(ws.Rules) - 1; i >= 0; i-- {
+		if ws.Rules[i] != "" {
+			return ws.Rules[i], true
+		}
+	}
+	return
+}
+
+// Walk calls v for node and everything in it, in document order.
+func Walk(node Node, v Visitor) {
+	WalkWithData(node, nil, v)
+}
+
+// WalkWithData is like Walk, but uses the ParseData that node was parsed with
+// to fill in the names of rules.
+func WalkWithData(node Node, pd *ParseData, v Visitor) {
+	ws := &WalkState{pd: pd}
+	ws.walk(node, v)
+}
+
+func (ws *WalkState) walk(node Node, v Visitor) {
+	descend := v.Enter(node, ws)
+	var nodes []Node
+	switch n := node.(type) {
+	case []Node:
+		nodes = n
+	case AST:
+		nodes = []Node(n)
+	default:
+		descend = false
+	}
+	if descend {
+		name, _ := ws.pd.RuleName(nodes)
+		ws.Parents = append(ws.Parents, nodes)
+		ws.Indices = append(ws.Indices, 0)
+		ws.Rules = append(ws.Rules, name)
+		for i, child := range nodes {
+			ws.Indices[len(ws.Indices)-1] = i
+			ws.walk(child, v)
+		}
+		last := len(ws.Parents) - 1
+		ws.Parents, ws.Indices, ws.Rules = ws.Parents[:last], ws.Indices[:last], ws.Rules[:last]
+	}
+	v.Leave(node, ws)
+}
+
+// VisitorFuncs makes a Visitor out of functions, either of which may be nil.
+// A nil EnterFunc descends into every subtree.
+type VisitorFuncs struct {
+	EnterFunc func(node Node, ws *WalkState) bool
+	LeaveFunc func(node Node, ws *WalkState)
+}
+
+func (vf VisitorFuncs) Enter(node Node, ws *WalkState) bool {
+	if vf.EnterFunc == nil {
+		return true
+	}
+	return vf.EnterFunc(node, ws)
+}
+
+func (vf VisitorFuncs) Leave(node Node, ws *WalkState) {
+	if vf.LeaveFunc != nil {
+		vf.LeaveFunc(node, ws)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2013 The gopp AUTHORS. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gopp_test
+
+import (
+	"github.com/skelterjohn/gopp"
+	"reflect"
+	"testing"
+)
+
+func walkSubtree(node gopp.Node) (nodes []gopp.Node, ok bool) {
+	switch node := node.(type) {
+	case gopp.AST:
+		return []gopp.Node(node), true
+	case []gopp.Node:
+		return node, true
+	}
+	return
+}
+
+func TestWalk(t *testing.T) {
+	pd := gopp.NewParseData()
+	document := "X => 'y' <<Z>>\nZ => <w>\nw = /w/\n"
+	ast, err := gopp.ParseWithData(gopp.ByHandGrammar, "Grammar", []byte(document), pd)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// identifiers, and the rules they were found in, skipping symbols.
+	var found []string
+	depth, entered := 0, 0
+	gopp.WalkWithData(ast, pd, gopp.VisitorFuncs{
+		EnterFunc: func(node gopp.Node, ws *gopp.WalkState) bool {
+			entered++
+			if ws.Depth() != depth {
+				t.Errorf("Expected depth %d, got %d.", depth, ws.Depth())
+			}
+			if nodes, ok := walkSubtree(node); ok {
+				if name, _ := pd.RuleName(nodes); name == "Symbol" {
+					return false
+				}
+				depth++
+			}
+			if st, ok := node.(gopp.SymbolText); ok && st.Type == "identifier" {
+				rule, _ := ws.Rule()
+				found = append(found, rule+":"+st.Text)
+				if ws.Parent()[ws.Indices[len(ws.Indices)-1]] != node {
+					t.Errorf("Expected %v to be in its parent.", node)
+				}
+			}
+			return true
+		},
+		LeaveFunc: func(node gopp.Node, ws *gopp.WalkState) {
+			entered--
+			if nodes, ok := walkSubtree(node); ok {
+				if name, _ := pd.RuleName(nodes); name != "Symbol" {
+					depth--
+				}
+			}
+		},
+	})
+	expected := []string{"Rule:X", "Term:Z", "Rule:Z", "Term:w"}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("Expected %v, got %v.", expected, found)
+	}
+	if entered != 0 {
+		t.Errorf("Enter and Leave were called %d more times than each other.", entered)
+	}
+
+	// without the ParseData, there are no rule names.
+	gopp.Walk(ast, gopp.VisitorFuncs{
+		EnterFunc: func(node gopp.Node, ws *gopp.WalkState) bool {
+			if name, ok := ws.Rule(); ok {
+				t.Errorf("Expected no rule names, got %q.", name)
+				return false
+			}
+			return true
+		},
+	})
+}